@@ -0,0 +1,159 @@
+package hackberry
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// Clock provides the current time and timers to state machine. The default
+// clock uses package time, a ManualClock can be used in tests so that they
+// need not sleep.
+type Clock interface{
+    // Now returns the current time.
+    Now() time.Time
+
+    // AfterFunc waits for the duration to elapse and then calls f, it returns
+    // a Timer that can be used to cancel the call.
+    AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a single event timer created by Clock.
+type Timer interface{
+    // Stop prevents the timer from firing. It returns false if the timer has
+    // already fired or been stopped.
+    Stop() bool
+}
+
+// realClock implements Clock by package time.
+type realClock struct{
+}
+
+// NewRealClock creates a clock that uses package time, it is the default clock
+// of state machine.
+func NewRealClock() Clock{
+    return realClock{}
+}
+
+func (c realClock) Now() time.Time{
+    return time.Now()
+}
+
+func (c realClock) AfterFunc(d time.Duration, f func()) Timer{
+    return time.AfterFunc(d, f)
+}
+
+// ManualClock is a clock whose time only changes by Advance. The functions of
+// timers are called synchronously in Advance, so tests are deterministic.
+type ManualClock struct{
+    now time.Time
+
+    // the timers not fired and not stopped yet
+    timers []*manualTimer
+
+    // the sequence of creating timers, to keep the order of timers due at
+    // the same time
+    seq int
+
+    locker sync.Mutex
+}
+
+// manualTimer is a timer created by ManualClock.
+type manualTimer struct{
+    clock *ManualClock
+    when time.Time
+    seq int
+    f func()
+}
+
+// NewManualClock creates a manual clock whose current time is now.
+func NewManualClock(now time.Time) *ManualClock{
+    return &ManualClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time{
+    c.locker.Lock()
+    defer c.locker.Unlock()
+
+    return c.now
+}
+
+// AfterFunc creates a timer that calls f when the clock is advanced by d. If d
+// is not greater than zero, f is called by the next Advance.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer{
+    c.locker.Lock()
+    defer c.locker.Unlock()
+
+    c.seq++
+    t := &manualTimer{c, c.now.Add(d), c.seq, f}
+    c.timers = append(c.timers, t)
+    return t
+}
+
+// Advance moves the current time forward by d, and calls the functions of
+// timers due in the order of their due time. The current time is set to the
+// due time of each timer when calling its function, so timers created by the
+// function are fired too if they are due before the end.
+func (c *ManualClock) Advance(d time.Duration){
+    c.locker.Lock()
+    end := c.now.Add(d)
+    c.locker.Unlock()
+
+    for {
+        t := c.nextDueTimer(end)
+        if t == nil { break }
+        t.f()
+    }
+
+    c.locker.Lock()
+    c.now = end
+    c.locker.Unlock()
+}
+
+// PendingTimers returns the number of timers not fired and not stopped.
+func (c *ManualClock) PendingTimers() int{
+    c.locker.Lock()
+    defer c.locker.Unlock()
+
+    return len(c.timers)
+}
+
+// nextDueTimer removes and returns the first timer due before end, and sets
+// the current time to its due time. It returns nil if there is no one.
+func (c *ManualClock) nextDueTimer(end time.Time) *manualTimer{
+    c.locker.Lock()
+    defer c.locker.Unlock()
+
+    sort.Slice(c.timers, func(i, j int) bool{
+        if c.timers[i].when.Equal(c.timers[j].when) {
+            return c.timers[i].seq < c.timers[j].seq
+        }
+        return c.timers[i].when.Before(c.timers[j].when)
+    })
+    if len(c.timers) == 0 || c.timers[0].when.After(end) {
+        return nil
+    }
+
+    t := c.timers[0]
+    c.timers = c.timers[1:]
+    if t.when.After(c.now) {
+        c.now = t.when
+    }
+    return t
+}
+
+// Stop removes the timer from its clock.
+func (t *manualTimer) Stop() bool{
+    c := t.clock
+    c.locker.Lock()
+    defer c.locker.Unlock()
+
+    for i, o := range c.timers {
+        if o == t {
+            c.timers = append(c.timers[:i:i], c.timers[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
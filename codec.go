@@ -0,0 +1,125 @@
+package hackberry
+
+import (
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+)
+
+// AttributeCodec encodes and decodes the attributes of context in snapshots.
+// The encoded data is embedded in the json of snapshot, so it must be json. A
+// binary encoding can be stored as a json string.
+type AttributeCodec interface{
+    // Encode encodes all attributes of context.
+    Encode(attributes map[Any]Any) (json.RawMessage, error)
+
+    // Decode decodes the attributes encoded by Encode.
+    Decode(data json.RawMessage) (map[Any]Any, error)
+}
+
+// JSONAttributeCodec is the default AttributeCodec of state machine. It keeps
+// the type name of each attribute, so the attributes are decoded to the same
+// types. Keys should be strings, and values should be nil, the basic types of
+// Go or the types registered by Register.
+type JSONAttributeCodec struct{
+    // the registered types by name, and the names by type.
+    types map[string]reflect.Type
+    names map[reflect.Type]string
+}
+
+// attribute defines one encoded attribute.
+type attribute struct{
+    Key string              `json:"key"`
+    Type string             `json:"type"`
+    Value json.RawMessage   `json:"value,omitempty"`
+}
+
+// NewJSONAttributeCodec creates a JSONAttributeCodec, the basic types are
+// registered by their names, such as "int", "float64" and "string".
+func NewJSONAttributeCodec() *JSONAttributeCodec{
+    c := &JSONAttributeCodec{make(map[string]reflect.Type), make(map[reflect.Type]string)}
+    basics := []Any{false, "", int(0), int8(0), int16(0), int32(0), int64(0), uint(0), uint8(0),
+        uint16(0), uint32(0), uint64(0), float32(0), float64(0)}
+    for _, v := range basics {
+        c.Register(reflect.TypeOf(v).String(), v)
+    }
+    return c
+}
+
+// Register registers the type of value by a name, the attributes of the type
+// are encoded by package encoding/json. The name is saved in snapshots, so it
+// should not be changed after saving.
+func (c *JSONAttributeCodec) Register(name string, value Any) *JSONAttributeCodec{
+    t := reflect.TypeOf(value)
+    if t == nil {
+        panic(&ConfigError{Message: "Can't register nil for type [" + name + "]."})
+    }
+    if o, ok := c.types[name]; ok && o != t {
+        panic(&ConfigError{Message: "Type name [" + name + "] is registered already."})
+    }
+
+    c.types[name] = t
+    c.names[t] = name
+    return c
+}
+
+// Encode encodes the attributes to a json array sorted by keys.
+func (c *JSONAttributeCodec) Encode(attributes map[Any]Any) (json.RawMessage, error){
+    list := make([]attribute, 0, len(attributes))
+    for k, v := range attributes {
+        key, ok := k.(string)
+        if !ok {
+            return nil, &SnapshotError{Message: fmt.Sprintf("Attribute key [%v] is not a string.", k)}
+        }
+
+        a := attribute{Key: key, Type: "nil"}
+        if v != nil {
+            name, ok := c.names[reflect.TypeOf(v)]
+            if !ok {
+                msg := fmt.Sprintf("Type [%T] of attribute [%s] is not registered.", v, key)
+                return nil, &SnapshotError{Message: msg}
+            }
+
+            data, err := json.Marshal(v)
+            if err != nil {
+                return nil, &SnapshotError{Message: "Can't encode attribute [" + key + "].", Cause: err}
+            }
+            a.Type = name
+            a.Value = data
+        }
+        list = append(list, a)
+    }
+    sort.Slice(list, func(i, j int) bool{
+        return list[i].Key < list[j].Key
+    })
+    return json.Marshal(list)
+}
+
+// Decode decodes the attributes from the json array encoded by Encode.
+func (c *JSONAttributeCodec) Decode(data json.RawMessage) (map[Any]Any, error){
+    var list []attribute
+    if err := json.Unmarshal(data, &list); err != nil {
+        return nil, &SnapshotError{Message: "Can't decode attributes.", Cause: err}
+    }
+
+    attributes := make(map[Any]Any)
+    for _, a := range list {
+        if a.Type == "nil" {
+            attributes[a.Key] = nil
+            continue
+        }
+
+        t, ok := c.types[a.Type]
+        if !ok {
+            msg := "Type [" + a.Type + "] of attribute [" + a.Key + "] is not registered."
+            return nil, &SnapshotError{Message: msg}
+        }
+        v := reflect.New(t)
+        if err := json.Unmarshal(a.Value, v.Interface()); err != nil {
+            return nil, &SnapshotError{Message: "Can't decode attribute [" + a.Key + "].", Cause: err}
+        }
+        attributes[a.Key] = v.Elem().Interface()
+    }
+    return attributes, nil
+}
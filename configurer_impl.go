@@ -3,6 +3,9 @@ package hackberry
 import (
     "os"
     "bufio"
+    "strings"
+    "strconv"
+    "time"
     "encoding/json"
     "encoding/xml"
 )
@@ -17,16 +20,66 @@ type stateMachine struct{
     Defaultstate bool    `xml:"defaultstate,attr"`
     Initialstate string  `xml:"initialstate,attr"`
     Timeoutstate string  `xml:"timeoutstate,attr"`
-    States []state       `xml:"state"`
+    States []state       `xml:",any"`   // for xml, state, parallel or final element
 }
 
 // state defines a struct for unmarshal json and xml file.
 type state struct{
+    XMLName xml.Name     // for xml, the element name
     Id string            `xml:"id,attr"`
-    Timeout float64      `xml:"timeout,attr"`
+    Initial string       `xml:"initial,attr"`
+    Timeout duration     `xml:"timeout,attr"`
+    Defer string         `xml:"defer,attr"`    // event descriptors separated by spaces
     Onentry []action     `xml:"onentry"`
     Onexit []action      `xml:"onexit"`
     Transitions []transition    `xml:"transition"`
+    Timers []timer       `xml:"timer"`
+    Parallel bool        `xml:"-"`      // for json
+    Final bool           `xml:"-"`      // for json
+    Type string          `xml:"type,attr"`  // for xml, the type of history element
+    History string       `xml:"-"`      // for json, the type of history
+    States []state       `xml:",any"`   // for xml, state, parallel, final or history element
+}
+
+// isHistory returns if the state is a history pseudo-state.
+func (s *state) isHistory() bool{
+    return s.XMLName.Local == "history" || s.History != ""
+}
+
+// duration defines a time duration for unmarshal json and xml file. It is a
+// number of seconds, which can have fraction, or a string of seconds or Go
+// duration, such as "0.5", "250ms" and "1m30s".
+type duration time.Duration
+
+// UnmarshalText unmarshals a duration from xml attribute or json string.
+func (d *duration) UnmarshalText(text []byte) error{
+    s := strings.TrimSpace(string(text))
+    if f, err := strconv.ParseFloat(s, 64); err == nil {
+        *d = duration(f * float64(time.Second))
+        return nil
+    }
+    
+    v, err := time.ParseDuration(s)
+    if err != nil {
+        return &ParseError{Message: "Can't parse duration value from string [" + s + "].", Cause: err}
+    }
+    *d = duration(v)
+    return nil
+}
+
+// MarshalText marshals a duration to a Go duration string, it is used by
+// snapshots.
+func (d duration) MarshalText() ([]byte, error){
+    return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalJSON unmarshals a duration from json number or string.
+func (d *duration) UnmarshalJSON(data []byte) error{
+    var s string
+    if err := json.Unmarshal(data, &s); err == nil {
+        return d.UnmarshalText([]byte(s))
+    }
+    return d.UnmarshalText(data)
 }
 
 // action defines a struct for unmarshal json and xml file.
@@ -36,11 +89,21 @@ type action struct{
     ParasXML []string    `xml:"para"`    // for xml    
 }
 
+// timer defines a struct for unmarshal json and xml file.
+type timer struct{
+    Name string          `xml:"name,attr"`
+    Delay duration       `xml:"delay,attr"`
+    Event string         `xml:"event,attr"`
+    Repeat bool          `xml:"repeat,attr"`
+}
+
 // transition defines a struct for unmarshal json and xml file.
 type transition struct{
     Event string         `xml:"event,attr"`
     Cond string          `xml:"cond,attr"`
     Target string        `xml:"target,attr"`
+    Type string          `xml:"type,attr"`
+    Actions []action     `xml:"action"`
 }
 
 // NewConfigurerJSON creates a configurerImpl to parses json file to configure
@@ -59,19 +122,54 @@ type transition struct{
 //	       {"event":"e1", "target":"s2"}
 //	     ]},
 //	   {"id":"s2",
+//	     "defer":"save sync.*",
+//	     "timers":[
+//	       {"name":"reminder", "delay":"1h", "event":"remind", "repeat":true},
+//	       {"name":"expire", "delay":"24h", "event":"expire"}
+//	     ],
 //	     "onentry":[
 //	         {"name":"a1.M2",
 //	          "paras":["abc", 123, true, 456.789]},
 //	         {"name":"a2.M1"}
 //	       ],
 //	     "transitions":[
-//	       {"event":"e2", "cond":"x=1", "target":"s3"},
-//	       {"event":"e2", "cond":"x=0", "target":"s1"}
+//	       {"event":"e2", "cond":"x=1", "target":"s3",
+//	        "actions":[
+//	          {"name":"a2.M2", "paras":["abc"]}
+//	        ]},
+//	       {"event":"e2", "cond":"x=0", "target":"s1"},
+//	       {"event":"e5", "type":"internal",
+//	        "actions":[
+//	          {"name":"a2.M1"}
+//	        ]}
 //	     ]},
 //	   {"id":"s3",
+//	     "initial":"s32",
+//	     "timeout":"1m30s",
 //	     "transitions":[
-//	       {"event":"e3", "target":"s1"}
-//	     ]}
+//	       {"event":"e3 error.*", "target":"s1"},
+//	       {"cond":"x=2", "target":"s2"}
+//	     ],
+//	     "states":[
+//	       {"id":"s31"},
+//	       {"id":"s32",
+//	         "transitions":[
+//	           {"event":"e4", "target":"s31"}
+//	         ]},
+//	       {"id":"h3",
+//	         "history":"deep",
+//	         "transitions":[
+//	           {"target":"s32"}
+//	         ]}
+//	     ]},
+//	   {"id":"s4",
+//	     "parallel":true,
+//	     "states":[
+//	       {"id":"s41"},
+//	       {"id":"s42"}
+//	     ]},
+//	   {"id":"s5",
+//	     "final":true}
 //	 ]
 //	}
 //
@@ -110,17 +208,59 @@ func NewConfigurerJSON(JSONfile string) *configurerImpl{
 //	         <onexit name="a3" />
 //	         <transition event="e1" target="s2" />
 //	     </state>
-//	     <state id="s2">
-//	         <!-- with condition -->
-//	         <transition event="e2" cond="x=1" target="s3" />
+//	     <!-- defer defines event descriptors separated by spaces. The events that
+//	          enable no transition are kept, and offered again after leaving s2. -->
+//	     <state id="s2" defer="save sync.*">
+//	         <!-- named timers, each sends its event after the delay, and again
+//	              every delay if repeat is true. they are cancelled when exiting s2. -->
+//	         <timer name="reminder" delay="1h" event="remind" repeat="true" />
+//	         <timer name="expire" delay="24h" event="expire" />
+//	         <!-- with condition and actions executed by transition -->
+//	         <transition event="e2" cond="x=1" target="s3">
+//	             <action name="a2.m2">
+//	                 <para>abc</para>
+//	             </action>
+//	         </transition>
 //	         <transition event="e2" cond="x=0" target="s1" />
+//	         <!-- internal transition, type is internal or external, external default.
+//	              without target, it only executes its actions. -->
+//	         <transition event="e5" type="internal">
+//	             <action name="a2.m1" />
+//	         </transition>
 //	     </state>
-//	     <!-- set timeout for state. should set state machine's timeoutEvent first. -->
-//	     <state id="s3" timeout="30">
-//	         <transition event="e3" target="s1" />
+//	     <!-- set timeout for state. should set state machine's timeoutEvent first.
+//	          timeout is seconds that can have fraction, or Go duration like "250ms". -->
+//	     <state id="s3" timeout="0.5">
+//	         <!-- event descriptors separated by spaces, "error.*" matches events
+//	              named "error" or prefixed with "error.", "*" matches all events -->
+//	         <transition event="e3 error.*" target="s1" />
 //	         <!-- timeoutEvent's name should be as the follow name, it is "timeout" here -->
 //	         <transition event="timeout" target="s2" />
+//	         <!-- eventless transition, taken automatically when condition is satisfied -->
+//	         <transition cond="x=2" target="s2" />
+//	     </state>
+//	     <!-- compound state, its transitions apply to all its sub states.
+//	          initial defines the initial sub state, it is the first one default. -->
+//	     <state id="s4" initial="s42">
+//	         <transition event="e4" target="s1" />
+//	         <state id="s41" />
+//	         <state id="s42">
+//	             <transition event="e5" target="s41" />
+//	         </state>
+//	         <!-- history pseudo-state, type is shallow or deep, shallow default.
+//	              the target of transition is the default target. -->
+//	         <history id="h4" type="deep">
+//	             <transition target="s42" />
+//	         </history>
 //	     </state>
+//	     <!-- parallel state, all its sub states are active at the same time -->
+//	     <parallel id="s5">
+//	         <state id="s51" />
+//	         <state id="s52" />
+//	     </parallel>
+//	     <!-- final state, state machine stops when entering a top level final state.
+//	          entering a final sub state raises event "done.state." + parent's id. -->
+//	     <final id="s6" />
 //	 </scxml>
 //
 func NewConfigurerXML(XMLfile string) *configurerImpl{
@@ -131,22 +271,38 @@ func NewConfigurerXML(XMLfile string) *configurerImpl{
     return c
 }
 
+// NewConfigurerJSONE is like NewConfigurerJSON, but returns a *ConfigError
+// instead of panic if the file can't be opened or parsed. The error wraps the
+// error of opening or decoding the file.
+func NewConfigurerJSONE(JSONfile string) (c *configurerImpl, err error){
+    defer catchError(&err)
+    return NewConfigurerJSON(JSONfile), nil
+}
+
+// NewConfigurerXMLE is like NewConfigurerXML, but returns a *ConfigError
+// instead of panic if the file can't be opened or parsed. The error wraps the
+// error of opening or decoding the file.
+func NewConfigurerXMLE(XMLfile string) (c *configurerImpl, err error){
+    defer catchError(&err)
+    return NewConfigurerXML(XMLfile), nil
+}
+
 // configure loads configuration to state machine.
 func (c *configurerImpl)configure(sm *StateMachine) {
     if sm == nil {
-        panic(&ConfigError{"State machine is nil!"})
+        panic(&ConfigError{Message: "State machine is nil!"})
     }
     
     csm := c.csm
     for _, s := range csm.States {
-        c.parseState(s, sm, csm.Defaultstate)
+        c.parseState(s, "", sm, csm.Defaultstate)
     }
     
     if csm.Initialstate != "" && sm.getState(csm.Initialstate) == nil {
-        panic(&ConfigError{"Has no initial state [" + csm.Initialstate + "]."})
+        panic(&ConfigError{Message: "Has no initial state [" + csm.Initialstate + "]."})
     }
     if csm.Timeoutstate != "" && sm.getState(csm.Timeoutstate) == nil {
-        panic(&ConfigError{"Has no timeout state [" + csm.Timeoutstate + "]."})
+        panic(&ConfigError{Message: "Has no timeout state [" + csm.Timeoutstate + "]."})
     }
     
     sm.SetInitialStateID(csm.Initialstate)
@@ -157,7 +313,7 @@ func (c *configurerImpl)configure(sm *StateMachine) {
 func (c *configurerImpl)parseStateMachineFromFile(file, format string){
     input, err := os.Open(file)
     if err != nil {
-        panic(&ConfigError{"An error occurred on opening file: " + file})
+        panic(&ConfigError{Message: "An error occurred on opening file: " + file, Cause: err})
     }
     defer input.Close()
 
@@ -172,23 +328,61 @@ func (c *configurerImpl)parseStateMachineFromFile(file, format string){
     }
     
     if err != nil{
-        panic(&ConfigError{"Fail to parse config file: " + err.Error()})
+        panic(&ConfigError{Message: "Fail to parse config file: " + file, Cause: err})
     }
 }
 
-// parseState parses state configuration from stateMachine struct.
-func (c *configurerImpl)parseState(s state, sm *StateMachine, useDefaultState bool){
+// parseState parses state configuration from stateMachine struct. The state
+// is a top level state if parentID is empty.
+func (c *configurerImpl)parseState(s state, parentID string, sm *StateMachine, useDefaultState bool){
+    switch s.XMLName.Local {
+        case "", "state":
+        case "parallel":
+            s.Parallel = true
+        case "final":
+            s.Final = true
+        case "history":
+            if s.Type == "" {
+                s.Type = "shallow"
+            }
+            s.History = s.Type
+        default:
+            panic(&ConfigError{Message: "Unsupported element [" + s.XMLName.Local + "]."})
+    }
+    
+    if s.History != "" {
+        c.parseHistory(s, parentID, sm)
+        return
+    }
+    
     state := sm.getState(s.Id)
     if state == nil && useDefaultState {
-        sm.AddState(&DefaultState{s.Id})
-        state = sm.getState(s.Id)
+        state = &DefaultState{s.Id}
     }
     if state == nil {
-        panic(&ConfigError{"Has no state [" + s.Id + "]."})
+        panic(&ConfigError{Message: "Has no state [" + s.Id + "]."})
+    }
+    
+    if parentID == "" {
+        sm.AddState(state)
+    }else{
+        sm.AddSubState(parentID, state)
+    }
+    
+    if s.Parallel {
+        sm.SetParallel(s.Id)
     }
     
     if s.Timeout > 0 {
-        sm.AddTimeout(s.Id, int(s.Timeout))
+        sm.AddTimeoutDuration(s.Id, time.Duration(s.Timeout))
+    }
+    
+    if s.Defer != "" {
+        sm.AddDefer(s.Id, strings.Fields(s.Defer)...)
+    }
+    
+    for _, t := range s.Timers{
+        sm.AddStateTimer(s.Id, StateTimer{t.Name, time.Duration(t.Delay), NewDefaultEvent(t.Event, nil), t.Repeat})
     }
     
     for _, a := range s.Onentry{
@@ -200,7 +394,56 @@ func (c *configurerImpl)parseState(s state, sm *StateMachine, useDefaultState bo
     }
         
     for _, t := range s.Transitions{
-        sm.AddTransition(c.parseTransition(s.Id, t))
+        tran, actions := c.parseTransition(s.Id, t)
+        switch t.Type {
+            case "", "external":
+                sm.AddTransition(tran, actions...)
+            case "internal":
+                sm.AddInternalTransition(tran, actions...)
+            default:
+                panic(&ConfigError{Message: "Unsupported transition type [" + t.Type + "]."})
+        }
+    }
+    
+    // histories are parsed after states, their default targets should exist.
+    for _, sub := range s.States{
+        if !sub.isHistory() {
+            c.parseState(sub, s.Id, sm, useDefaultState)
+        }
+    }
+    for _, sub := range s.States{
+        if sub.isHistory() {
+            c.parseState(sub, s.Id, sm, useDefaultState)
+        }
+    }
+    
+    if s.Initial != "" {
+        sm.SetInitialSubStateID(s.Id, s.Initial)
+    }
+    
+    if s.Final {
+        sm.SetFinal(s.Id)
+    }
+}
+
+// parseHistory parses history configuration from stateMachine struct. The
+// target of its first transition is the default target.
+func (c *configurerImpl)parseHistory(s state, parentID string, sm *StateMachine){
+    if parentID == "" {
+        panic(&ConfigError{Message: "History [" + s.Id + "] should be in a state."})
+    }
+    
+    switch s.History {
+        case "shallow":
+            sm.AddHistory(parentID, s.Id, HISTORY_SHALLOW)
+        case "deep":
+            sm.AddHistory(parentID, s.Id, HISTORY_DEEP)
+        default:
+            panic(&ConfigError{Message: "Unsupported history type [" + s.History + "]."})
+    }
+    
+    if len(s.Transitions) > 0 {
+        sm.SetHistoryDefault(s.Id, s.Transitions[0].Target)
     }
 }
 
@@ -220,11 +463,15 @@ func (c *configurerImpl)parseAction(ac action)(a Action){
     return
 }
 
-// parseTransition parses transition configuration to create a Transition.
-func (c *configurerImpl)parseTransition(stateId string, tran transition)(t Transition){
+// parseTransition parses transition configuration to create a Transition and
+// its actions.
+func (c *configurerImpl)parseTransition(stateId string, tran transition)(t Transition, actions []Action){
     t.SourceID = stateId
     t.TargetID = tran.Target
     t.EventName = tran.Event
     t.Condition = tran.Cond
+    for _, a := range tran.Actions{
+        actions = append(actions, c.parseAction(a))
+    }
     return
 }
@@ -22,23 +22,25 @@ func (ad *defaultActionDispatcher)AddActionExecutor(name string, executor Any) *
     return ad
 }
 
-// Dispatch dispathes a action to its corresponding method.
+// Dispatch dispathes a action to its corresponding method. A string parameter
+// prefixed with "_event." is replaced by the data value of event that state
+// machine is processing, such as "_event.amount".
 func (ad *defaultActionDispatcher)Dispatch(a Action, context *Context){
     names := strings.Split(a.Name, `.`)
     if len(names) != 2 {
-        panic(&ActionError{"Action name format should be like objname.method, but [" + a.Name + "]."})
+        panic(&ActionError{Message: "Action name format should be like objname.method, but [" + a.Name + "]."})
     }
     
     execName := names[0]
     methodName := names[1];
     executor := ad.executors[execName]
     if executor == nil {
-        panic(&ActionError{"Has no action executor for [" + execName + "]."})
+        panic(&ActionError{Message: "Has no action executor for [" + execName + "]."})
     }
     
     method := reflect.ValueOf(executor).MethodByName(methodName)
     if !method.IsValid() {
-        panic(&ActionError{"Has no method [" + a.Name + "]."})
+        panic(&ActionError{Message: "Has no method [" + a.Name + "]."})
     }
     
     methodS, _ := reflect.TypeOf(executor).MethodByName(methodName)
@@ -46,11 +48,17 @@ func (ad *defaultActionDispatcher)Dispatch(a Action, context *Context){
     
     // NumIn take receiver as the first parameter
     if methodT.NumIn() - 1 != len(a.Parameters) {
-        panic(&ActionError{"Parameter number is not correct for method [" + a.Name + "]."})
+        panic(&ActionError{Message: "Parameter number is not correct for method [" + a.Name + "]."})
     }
     
     params := make([]reflect.Value, len(a.Parameters))
     for i, p := range a.Parameters{
+        if s, ok := p.(string); ok && strings.HasPrefix(s, EVENT_DATA_PREFIX) {
+            p = context.GetEventData(strings.TrimPrefix(s, EVENT_DATA_PREFIX))
+            if p == nil {
+                panic(&ActionError{Message: "Has no event data [" + s + "] for method [" + a.Name + "]."})
+            }
+        }
         v := transValue(methodT.In(i + 1).Name(), p, a.Name)
         params[i] = reflect.ValueOf(v)
     }
@@ -59,6 +67,15 @@ func (ad *defaultActionDispatcher)Dispatch(a Action, context *Context){
 
 // transValue converts a value to named type.
 func transValue(name string, v Any, action string) Any{
+    defer func(){
+        if r := recover(); r != nil {
+            if e, ok := r.(*ParseError); ok {
+                panic(&ActionError{Message: "Can't convert parameter for method [" + action + "].", Cause: e})
+            }
+            panic(r)
+        }
+    }()
+    
     s := fmt.Sprintf("%v", v)
     switch name{
         case "bool":
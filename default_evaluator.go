@@ -5,6 +5,10 @@ import (
     "strings"
 )
 
+// EVENT_DATA_PREFIX is the prefix of names that refer to the data of the event
+// that state machine is processing, such as "_event.amount".
+const EVENT_DATA_PREFIX = "_event."
+
 // The supported operators in default condition evaluator. There are only six operators now.
 const (
     OPERATOR_EQ string = "="
@@ -25,19 +29,31 @@ type defaultConditionEvaluator struct{
 // It supports six operations now: =, !=, <, <=, > and >=.
 // The types of attribute include: bool, int8, int16, int32, int64, int
 // uint8, uint16, uint32, uint64, uint, float32, float64, string.
+// If the attribute name is prefixed with "_event.", the value is from the
+// data of event that state machine is processing, such as "_event.amount>100".
 func NewDefaultConditionEvaluator() *defaultConditionEvaluator{
     return &defaultConditionEvaluator{}
 }
 
 // IsSatisfied implements the method of ConditionEvaluator interface.
-// It uses the attribute in the context to judge if the condition is satisfied or not.
+// It uses the attribute in the context or the event data to judge if the
+// condition is satisfied or not.
 func (ce *defaultConditionEvaluator) IsSatisfied(condition string, context *Context) bool{
+    defer func(){
+        if r := recover(); r != nil {
+            if e, ok := r.(*ParseError); ok {
+                panic(&ConditionError{Message: "Can't parse value of condition [" + condition + "].", Cause: e})
+            }
+            panic(r)
+        }
+    }()
+    
     op := getOperator(condition)
     cs := strings.Split(condition, op)
     name := strings.TrimSpace(cs[0])
     value := strings.TrimSpace(cs[1])
     
-    attrValue := context.GetAttribute(name);
+    attrValue := getValue(name, context)
     if attrValue == nil { return false }
     
     switch v := attrValue.(type){
@@ -71,8 +87,17 @@ func (ce *defaultConditionEvaluator) IsSatisfied(condition string, context *Cont
             return compareString(v, value, op)
         default:
             msg := fmt.Sprintf("Unsupported value type [%T] for condition [%s].", v, condition)
-            panic(&ConditionError{msg})    
+            panic(&ConditionError{Message: msg})    
+    }
+}
+
+// getValue returns the event data value if the name is prefixed with
+// EVENT_DATA_PREFIX, otherwise the attribute value in context.
+func getValue(name string, context *Context) Any{
+    if strings.HasPrefix(name, EVENT_DATA_PREFIX) {
+        return context.GetEventData(strings.TrimPrefix(name, EVENT_DATA_PREFIX))
     }
+    return context.GetAttribute(name)
 }
 
 // getOperator parses the condition string to get operator.
@@ -89,7 +114,7 @@ func getOperator(condition string) string{
         }
     }
     
-    panic(&ConditionError{"Unsupported operator of condition [" + condition + "]."})
+    panic(&ConditionError{Message: "Unsupported operator of condition [" + condition + "]."})
 }
 
 // compareBool compares two boolean.
@@ -100,7 +125,7 @@ func compareBool(v1, v2 bool, op string) bool{
         case OPERATOR_NE :
             return v1 != v2
         default:
-            panic(&ConditionError{"Unsupported bool operation [" + op + "]."})
+            panic(&ConditionError{Message: "Unsupported bool operation [" + op + "]."})
     }
 }
 
@@ -10,12 +10,25 @@ func (s *DefaultState) ID() string{
     return s.id
 }
 
-// DefaultEvent gives a default implementation of event interface.
+// DefaultEvent gives a default implementation of event interface. It is also
+// a DataEvent, the data may be nil.
 type DefaultEvent struct{
     name string
+    
+    data map[string]Any
+}
+
+// NewDefaultEvent creates a default event with its name and data.
+func NewDefaultEvent(name string, data map[string]Any) *DefaultEvent{
+    return &DefaultEvent{name, data}
 }
 
 // Name implements the Event interface method.
 func (e *DefaultEvent) Name() string{
     return e.name
 }
+
+// Data implements the DataEvent interface method.
+func (e *DefaultEvent) Data() map[string]Any{
+    return e.data
+}
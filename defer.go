@@ -0,0 +1,76 @@
+package hackberry
+
+// AddDefer makes a state defer events. eventNames are event descriptors as
+// Transition.EventName, such as "save" or "error.*". When an event sent to
+// state machine enables no transition and an active state defers it, the event
+// is kept instead of being dropped. The kept events are offered again in the
+// order of sending after each transition, if no active state defers them then.
+// The kept events are discarded when the state machine stops.
+func (sm *StateMachine) AddDefer(stateID string, eventNames ...string) *StateMachine{
+    sm.checkMutable()
+    if sm.states[stateID] == nil {
+        panic(&ConfigError{Message: "Has no state [" + stateID + "]."})
+    }
+    for _, name := range eventNames {
+        checkDescriptors(name)
+    }
+
+    sm.defers[stateID] = append(sm.defers[stateID], eventNames...)
+    return sm
+}
+
+// GetDefers returns the event descriptors deferred by a state.
+func (sm *StateMachine) GetDefers(state State) []string{
+    return sm.defers[state.ID()]
+}
+
+// GetDeferredEvents returns the events deferred and not processed yet, in the
+// order of sending. It can be called while processing events.
+func (sm *StateMachine) GetDeferredEvents() []Event{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+
+    events := make([]Event, len(sm.deferredEvents))
+    copy(events, sm.deferredEvents)
+    return events
+}
+
+// setDeferredEvents sets the events deferred, it is guarded by stateLocker so
+// that GetDeferredEvents can be called by other goroutines. Should lock before
+// call this method.
+func (sm *StateMachine) setDeferredEvents(events []Event){
+    sm.stateLocker.Lock()
+    defer sm.stateLocker.Unlock()
+
+    sm.deferredEvents = events
+}
+
+// isDeferred returns if an active state defers the event.
+func (sm *StateMachine) isDeferred(event Event) bool{
+    for id := range sm.active {
+        for _, name := range sm.defers[id] {
+            if matchEvent(name, event.Name()) { return true }
+        }
+    }
+    return false
+}
+
+// processDeferredEvents offers the first deferred event that is not deferred
+// any more, until all deferred events are deferred still. The senders of
+// deferred events don't wait for them, so their panics are reported to
+// listeners. Should lock before call this method.
+func (sm *StateMachine) processDeferredEvents(){
+    for sm.IsRunning() {
+        i := 0
+        for i < len(sm.deferredEvents) && sm.isDeferred(sm.deferredEvents[i]) {
+            i++
+        }
+        if i == len(sm.deferredEvents) { return }
+
+        event := sm.deferredEvents[i]
+        sm.setDeferredEvents(append(sm.deferredEvents[:i:i], sm.deferredEvents[i+1:]...))
+        if r := sm.recoverEvent(func(){ sm.offerEvent(event) }); r != nil {
+            sm.notifyFailed(event, r)
+        }
+    }
+}
@@ -0,0 +1,198 @@
+package hackberry
+
+import (
+    "time"
+)
+
+// definition is the configuration of state machine, include states, transitions,
+// actions and timers. It is changed by the methods of StateMachine until being
+// frozen, then it can be shared by state machines.
+type definition struct{
+    // state machine's initial state's id
+    initialStateID string
+    
+    // all states of this state machine
+    states map[string]State
+    
+    // the parent state's id of each sub state. Top level states have no parent.
+    parents map[string]string
+    
+    // the ids of sub states of each compound state, in the order of adding.
+    children map[string][]string
+    
+    // the initial sub state's id of compound states. If a compound state has
+    // no one, its first sub state is the initial sub state.
+    initialChildren map[string]string
+    
+    // the ids of parallel states. All sub states of a parallel state are active
+    // at the same time, each of them is a region.
+    parallels map[string]bool
+    
+    // the history pseudo-states of compound states.
+    histories map[string]history
+    
+    // the ids of final states.
+    finals map[string]bool
+    
+    // the event descriptors deferred by each state.
+    defers map[string][]string
+    
+    // the max times of taking eventless transitions after one event.
+    maxEventlessSteps int
+    
+    // the order of adding states.
+    order map[string]int
+    
+    // the document order of states, computed from the order of adding and
+    // the state hierarchy. It is nil after adding states.
+    docOrder map[string]int
+    
+    // all transitions of this state machine. Each state has a transition list.
+    transitions map[string][]transitionDef
+    
+    // all entry actions of this state machine. Each state has a entry action list.
+    entryActions map[string][]Action
+    
+    // all exit actions of this state machine. Each state has a exit action list.
+    exitActions map[string][]Action
+    
+    // all timeouts of state that are greater than zero.
+    timeouts map[string]time.Duration
+    
+    // condition evaluator
+    conditionEvaluator ConditionEvaluator
+    
+    // action dispatcher
+    actionDispatcher ActionDispatcher
+    
+    // timeout event. If some states have timeout greater than zero, this 
+    // attribute should be set.
+    timeoutEvent Event
+    
+    // thd id of default state when timeout happened.
+    defaultTimeoutStateID string
+    
+    // the named timers of each state.
+    stateTimers map[string][]StateTimer
+    
+    // if the definition is frozen, it can't be changed any more.
+    frozen bool
+}
+
+// Definition is a frozen and validated configuration of state machine. It is
+// built once, and shared by the state machines created from it, which only
+// hold their current states, contexts and timers. The condition evaluator and
+// action dispatcher are shared too, so they should be safe for concurrent use.
+type Definition struct{
+    def *definition
+}
+
+// newDefinition creates an empty definition.
+func newDefinition(ce ConditionEvaluator, ad ActionDispatcher) *definition{
+    return &definition{
+        states: make(map[string]State),
+        parents: make(map[string]string),
+        children: make(map[string][]string),
+        initialChildren: make(map[string]string),
+        parallels: make(map[string]bool),
+        histories: make(map[string]history),
+        finals: make(map[string]bool),
+        defers: make(map[string][]string),
+        maxEventlessSteps: DEFAULT_MAX_EVENTLESS_STEPS,
+        order: make(map[string]int),
+        transitions: make(map[string][]transitionDef),
+        entryActions: make(map[string][]Action),
+        exitActions: make(map[string][]Action),
+        timeouts: make(map[string]time.Duration),
+        stateTimers: make(map[string][]StateTimer),
+        conditionEvaluator: ce,
+        actionDispatcher: ad,
+    }
+}
+
+// NewDefinition creates a definition configured by f, such as:
+//
+//	def, err := NewDefinition(ce, ad, func(sm *StateMachine){
+//	    sm.LoadConfig(NewConfigurerXML("stateMachine.xml"))
+//	})
+//
+// The panics of configuring and validating are returned as errors.
+func NewDefinition(ce ConditionEvaluator, ad ActionDispatcher, f func(sm *StateMachine)) (*Definition, error){
+    sm := NewStateMachine(ce, ad)
+    if err := sm.Configure(f); err != nil {
+        return nil, err
+    }
+    return sm.Definition()
+}
+
+// Definition validates and freezes the configuration of state machine, and
+// returns it as a Definition. The configuration can't be changed after that,
+// the methods changing it panic with ConfigError.
+func (sm *StateMachine) Definition() (*Definition, error){
+    if !sm.frozen {
+        if err := sm.definition.validate(); err != nil {
+            return nil, err
+        }
+        sm.documentOrder()
+        sm.frozen = true
+    }
+    return &Definition{sm.definition}, nil
+}
+
+// NewStateMachine creates a state machine of the definition. It is stopped,
+// and uses the default clock and attribute codec like the one created by
+// NewStateMachine.
+func (d *Definition) NewStateMachine() *StateMachine{
+    return newStateMachine(d.def)
+}
+
+// GetInitialStateID returns the id of initial state of the definition.
+func (d *Definition) GetInitialStateID() string{
+    return d.def.initialStateID
+}
+
+// checkMutable panics if the configuration of state machine is frozen.
+func (sm *StateMachine) checkMutable(){
+    if sm.frozen {
+        panic(&ConfigError{Message: "The definition of state machine is frozen, it can't be changed."})
+    }
+}
+
+// validate checks that the initial state and the states referred by
+// transitions, actions, timers, defers and histories are added.
+func (d *definition) validate() error{
+    if d.states[d.initialStateID] == nil {
+        return &ConfigError{Message: "Has no initial state [" + d.initialStateID + "]."}
+    }
+    if d.defaultTimeoutStateID != "" && d.states[d.defaultTimeoutStateID] == nil {
+        return &ConfigError{Message: "Has no default timeout state [" + d.defaultTimeoutStateID + "]."}
+    }
+
+    for id, trans := range d.transitions {
+        if d.states[id] == nil {
+            return &ConfigError{Message: "Has no source state [" + id + "] of transitions."}
+        }
+        for _, t := range trans {
+            _, ok := d.histories[t.TargetID]
+            if t.TargetID != "" && !ok && d.states[t.TargetID] == nil {
+                return &ConfigError{Message: "Has no target state [" + t.TargetID + "] of transition."}
+            }
+        }
+    }
+
+    var ids []string
+    for id := range d.entryActions { ids = append(ids, id) }
+    for id := range d.exitActions { ids = append(ids, id) }
+    for id := range d.timeouts { ids = append(ids, id) }
+    for id := range d.stateTimers { ids = append(ids, id) }
+    for id := range d.defers { ids = append(ids, id) }
+    for _, h := range d.histories {
+        if h.defaultTargetID != "" { ids = append(ids, h.defaultTargetID) }
+    }
+    for _, id := range ids {
+        if d.states[id] == nil {
+            return &ConfigError{Message: "Has no state [" + id + "]."}
+        }
+    }
+    return nil
+}
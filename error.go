@@ -1,25 +1,219 @@
 package hackberry
 
 import (
-
+    "errors"
+    "fmt"
 )
 
+// ErrNotRunning is returned by TrySendEvent if the state machine is not running.
+var ErrNotRunning = errors.New("state machine is not running")
+
+// ErrEvicted is returned by TrySendEvent, TryStart and TryStop if the state
+// machine is evicted from memory by the passivation of Registry, it should be
+// got from the registry again.
+var ErrEvicted = errors.New("state machine is evicted")
+
+// ErrNotFound is returned by Store if there is no snapshot of the id.
+var ErrNotFound = errors.New("snapshot is not found")
+
+// ErrMachineNotFound is returned by Registry if there is no state machine of
+// the id.
+var ErrMachineNotFound = errors.New("state machine is not found")
+
+// ErrMachineExists is returned by Registry.Create if there is a state machine
+// of the id already.
+var ErrMachineExists = errors.New("state machine exists already")
+
+// ErrVersionConflict is returned by Store if the stored version is not the
+// expected one, the snapshot was saved or deleted by another one.
+var ErrVersionConflict = errors.New("snapshot version conflict")
+
 // ParseError is created when it's failure to parse a value from a string.
 type ParseError struct{
     Message string
+
+    // the underlying error, such as the error of strconv.
+    Cause error
+}
+
+func (e *ParseError) Error() string{
+    return errorMessage(e.Message, e.Cause)
+}
+
+func (e *ParseError) Unwrap() error{
+    return e.Cause
+}
+
+// NewParseError creates a ParseError with the message and the underlying
+// error cause, which can be nil.
+func NewParseError(message string, cause error) *ParseError{
+    return &ParseError{Message: message, Cause: cause}
 }
 
 // ConfigError is created when there is error to configure state machine.
 type ConfigError struct{
     Message string
+
+    // the underlying error, such as the error of opening or decoding config file.
+    Cause error
+}
+
+func (e *ConfigError) Error() string{
+    return errorMessage(e.Message, e.Cause)
+}
+
+func (e *ConfigError) Unwrap() error{
+    return e.Cause
+}
+
+// NewConfigError creates a ConfigError with the message and the underlying
+// error cause, which can be nil.
+func NewConfigError(message string, cause error) *ConfigError{
+    return &ConfigError{Message: message, Cause: cause}
 }
 
 // ActionError is created when can't dispatch a action normally.
 type ActionError struct{
     Message string
+
+    // the underlying error, such as the ParseError of a parameter.
+    Cause error
+}
+
+func (e *ActionError) Error() string{
+    return errorMessage(e.Message, e.Cause)
+}
+
+func (e *ActionError) Unwrap() error{
+    return e.Cause
+}
+
+// NewActionError creates a ActionError with the message and the underlying
+// error cause, which can be nil.
+func NewActionError(message string, cause error) *ActionError{
+    return &ActionError{Message: message, Cause: cause}
 }
 
 // ConditionError is created when can't evaluate a transition condition.
 type ConditionError struct{
     Message string
-}
\ No newline at end of file
+
+    // the underlying error, such as the ParseError of the compared value.
+    Cause error
+}
+
+func (e *ConditionError) Error() string{
+    return errorMessage(e.Message, e.Cause)
+}
+
+func (e *ConditionError) Unwrap() error{
+    return e.Cause
+}
+
+// NewConditionError creates a ConditionError with the message and the underlying
+// error cause, which can be nil.
+func NewConditionError(message string, cause error) *ConditionError{
+    return &ConditionError{Message: message, Cause: cause}
+}
+
+// SnapshotError is created when can't take or restore a snapshot of state
+// machine.
+type SnapshotError struct{
+    Message string
+
+    // the underlying error, such as the error of encoding or decoding json.
+    Cause error
+}
+
+func (e *SnapshotError) Error() string{
+    return errorMessage(e.Message, e.Cause)
+}
+
+func (e *SnapshotError) Unwrap() error{
+    return e.Cause
+}
+
+// NewSnapshotError creates a SnapshotError with the message and the underlying
+// error cause, which can be nil.
+func NewSnapshotError(message string, cause error) *SnapshotError{
+    return &SnapshotError{Message: message, Cause: cause}
+}
+
+// StoreError is created when a store can't read or write snapshots.
+type StoreError struct{
+    Message string
+
+    // the underlying error, such as the error of file system.
+    Cause error
+}
+
+func (e *StoreError) Error() string{
+    return errorMessage(e.Message, e.Cause)
+}
+
+func (e *StoreError) Unwrap() error{
+    return e.Cause
+}
+
+// NewStoreError creates a StoreError with the message and the underlying
+// error cause, which can be nil.
+func NewStoreError(message string, cause error) *StoreError{
+    return &StoreError{Message: message, Cause: cause}
+}
+
+// JournalError is created when a journal can't be written, read or replayed.
+type JournalError struct{
+    Message string
+
+    // the underlying error, such as the error of file system.
+    Cause error
+}
+
+func (e *JournalError) Error() string{
+    return errorMessage(e.Message, e.Cause)
+}
+
+func (e *JournalError) Unwrap() error{
+    return e.Cause
+}
+
+// NewJournalError creates a JournalError with the message and the underlying
+// error cause, which can be nil.
+func NewJournalError(message string, cause error) *JournalError{
+    return &JournalError{Message: message, Cause: cause}
+}
+
+// errorMessage returns the message followed by the cause's message if any.
+func errorMessage(message string, cause error) string{
+    if cause == nil {
+        return message
+    }
+    return message + ": " + cause.Error()
+}
+
+// try calls f and returns its panic as an error.
+func try(f func()) (err error){
+    defer catchError(&err)
+    
+    f()
+    return nil
+}
+
+// catchError recovers a panic and sets it to err. It should be deferred by the
+// error returning methods. The errors of this package are set as they are, and
+// other panics are converted to errors.
+func catchError(err *error){
+    r := recover()
+    if r == nil { return }
+
+    *err = panicError(r)
+}
+
+// panicError returns a recovered panic as an error. The errors are returned as
+// they are, and other panics are converted to errors.
+func panicError(r Any) error{
+    if e, ok := r.(error); ok {
+        return e
+    }
+    return fmt.Errorf("panic: %v", r)
+}
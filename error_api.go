@@ -0,0 +1,135 @@
+package hackberry
+
+import (
+    "time"
+)
+
+// The methods in this file are the error returning variants of the methods
+// that panic. They recover the panic and return it as an error, which is one
+// of *ConfigError, *ActionError, *ConditionError and *ParseError usually.
+// errors.As can be used to get the error and errors.Unwrap to get its cause.
+
+// TrySendEvent is like SendEvent, but returns the error instead of panic when
+// processing events. It returns ErrNotRunning if the state machine is not
+// running, or ErrEvicted if it is evicted by the passivation of Registry. If
+// another goroutine is processing events, the event is only queued and nil is
+// returned, the error of processing it is reported to listeners by
+// OnEventFailed.
+func (sm *StateMachine) TrySendEvent(event Event) (err error){
+    defer catchError(&err)
+    
+    if !sm.IsRunning() {
+        return ErrNotRunning
+    }
+    
+    sm.SendEvent(event)
+    return nil
+}
+
+// TryStart is like Start, but returns the error instead of panic.
+func (sm *StateMachine) TryStart() (err error){
+    defer catchError(&err)
+    
+    sm.Start()
+    return nil
+}
+
+// TryStop is like Stop, but returns the error instead of panic.
+func (sm *StateMachine) TryStop() (err error){
+    defer catchError(&err)
+    
+    sm.Stop()
+    return nil
+}
+
+// LoadConfigE is like LoadConfig, but returns the error instead of panic.
+func (sm *StateMachine) LoadConfigE(configurer Configurer) (err error){
+    defer catchError(&err)
+    
+    if configurer == nil {
+        return &ConfigError{Message: "Configurer is nil!"}
+    }
+    sm.LoadConfig(configurer)
+    return nil
+}
+
+// Configure calls f to configure the state machine, and returns the error
+// instead of panic. It can be used with the chained methods, such as:
+//
+//	err := sm.Configure(func(sm *StateMachine){
+//	    sm.AddStates(states).
+//	      AddSubState("s1", s2).
+//	      SetFinal("s3")
+//	})
+//
+func (sm *StateMachine) Configure(f func(sm *StateMachine)) (err error){
+    defer catchError(&err)
+    
+    f(sm)
+    return nil
+}
+
+// AddTransitionE is like AddTransition, but returns the error instead of panic.
+func (sm *StateMachine) AddTransitionE(t Transition, actions ...Action) (err error){
+    defer catchError(&err)
+    
+    sm.AddTransition(t, actions...)
+    return nil
+}
+
+// AddInternalTransitionE is like AddInternalTransition, but returns the error
+// instead of panic.
+func (sm *StateMachine) AddInternalTransitionE(t Transition, actions ...Action) (err error){
+    defer catchError(&err)
+    
+    sm.AddInternalTransition(t, actions...)
+    return nil
+}
+
+// AddOnEntryE is like AddOnEntry, but returns the error instead of panic.
+func (sm *StateMachine) AddOnEntryE(stateID string, a Action) (err error){
+    defer catchError(&err)
+    
+    sm.AddOnEntry(stateID, a)
+    return nil
+}
+
+// AddOnExitE is like AddOnExit, but returns the error instead of panic.
+func (sm *StateMachine) AddOnExitE(stateID string, a Action) (err error){
+    defer catchError(&err)
+    
+    sm.AddOnExit(stateID, a)
+    return nil
+}
+
+// AddTimeoutE is like AddTimeout, but returns the error instead of panic.
+func (sm *StateMachine) AddTimeoutE(stateID string, seconds int) (err error){
+    defer catchError(&err)
+    
+    sm.AddTimeout(stateID, seconds)
+    return nil
+}
+
+// AddTimeoutDurationE is like AddTimeoutDuration, but returns the error instead
+// of panic.
+func (sm *StateMachine) AddTimeoutDurationE(stateID string, d time.Duration) (err error){
+    defer catchError(&err)
+    
+    sm.AddTimeoutDuration(stateID, d)
+    return nil
+}
+
+// IsSatisfiedE is like IsSatisfied, but returns the error instead of panic.
+func (ce *defaultConditionEvaluator) IsSatisfiedE(condition string, context *Context) (ok bool, err error){
+    defer catchError(&err)
+    
+    return ce.IsSatisfied(condition, context), nil
+}
+
+// DispatchE is like Dispatch, but returns the error instead of panic.
+func (ad *defaultActionDispatcher) DispatchE(a Action, context *Context) (err error){
+    defer catchError(&err)
+    
+    ad.Dispatch(a, context)
+    return nil
+}
@@ -0,0 +1,36 @@
+package hackberry
+
+import (
+    "strings"
+)
+
+// matchEvent returns if the event name matches the event descriptors. The
+// descriptors are separated by spaces, and the name matches if it matches any
+// one of them. A descriptor matches the names that equal it or begin with it
+// followed by a dot, so "error" and "error.*" both match "error", "error.network"
+// and "error.network.dns", but not "errors". The descriptor "*" matches any name.
+func matchEvent(descriptors, name string) bool{
+    for _, d := range strings.Fields(descriptors) {
+        if d == "*" { return true }
+        
+        d = strings.TrimSuffix(d, ".*")
+        d = strings.TrimSuffix(d, ".")
+        if name == d || strings.HasPrefix(name, d + ".") {
+            return true
+        }
+    }
+    return false
+}
+
+// checkDescriptors panics if any of the event descriptors is invalid. As SCXML,
+// "*" is only allowed as a whole token, that is the descriptor "*" itself or
+// the end of a descriptor after a dot like "error.*", so "error*" is invalid.
+func checkDescriptors(descriptors string){
+    for _, d := range strings.Fields(descriptors) {
+        if d == "*" { continue }
+        
+        if strings.Contains(strings.TrimSuffix(d, ".*"), "*") {
+            panic(&ConfigError{Message: "Invalid event descriptor [" + d + "]."})
+        }
+    }
+}
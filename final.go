@@ -0,0 +1,65 @@
+package hackberry
+
+// The prefix of done event's name. When entering a final state, a done event
+// named with the prefix and the parent state's id is raised, such as 
+// "done.state.s1". When all regions of a parallel state are in final states,
+// a done event of the parallel state is raised too.
+const DONE_EVENT_PREFIX = "done.state."
+
+// SetFinal sets a state to be a final state, it should have no sub states.
+// Entering a final state raises the done event of its parent state. Entering
+// a top level final state makes the state machine exit all states and stop,
+// its status is STATUS_FINISHED then.
+func (sm *StateMachine) SetFinal(stateID string) *StateMachine{
+    sm.checkMutable()
+    if sm.states[stateID] == nil {
+        panic(&ConfigError{Message: "Has no state [" + stateID + "]."})
+    }
+    if sm.isCompound(stateID) {
+        panic(&ConfigError{Message: "Final state [" + stateID + "] can't have sub states."})
+    }
+    
+    sm.finals[stateID] = true
+    return sm
+}
+
+// IsFinal returns if the state is a final state.
+func (sm *StateMachine) IsFinal(state State) bool{
+    return sm.finals[state.ID()]
+}
+
+// raiseDoneEvents raises done events after entering a final state.
+func (sm *StateMachine) raiseDoneEvents(finalID string){
+    parentID, ok := sm.parents[finalID]
+    if !ok { return }
+    
+    sm.Raise(NewDefaultEvent(DONE_EVENT_PREFIX + parentID, nil))
+    
+    if grandID, ok := sm.parents[parentID]; ok && sm.parallels[grandID] && sm.isInFinalState(grandID) {
+        sm.Raise(NewDefaultEvent(DONE_EVENT_PREFIX + grandID, nil))
+    }
+}
+
+// isInFinalState returns if a compound state's active sub state is final, or
+// all regions of a parallel state are in final states.
+func (sm *StateMachine) isInFinalState(id string) bool{
+    if sm.parallels[id] {
+        for _, region := range sm.children[id] {
+            if !sm.isInFinalState(region) { return false }
+        }
+        return true
+    }
+    
+    for _, child := range sm.children[id] {
+        if sm.active[child] && sm.finals[child] { return true }
+    }
+    return false
+}
+
+// isFinished returns if a top level final state is active.
+func (sm *StateMachine) isFinished() bool{
+    for id := range sm.active {
+        if _, ok := sm.parents[id]; !ok && sm.finals[id] { return true }
+    }
+    return false
+}
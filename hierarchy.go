@@ -0,0 +1,224 @@
+package hackberry
+
+import (
+    "sort"
+)
+
+// activeStateIDs returns the ids of all active states in document order.
+func (sm *StateMachine) activeStateIDs() []string{
+    ids := make([]string, 0, len(sm.active))
+    for id := range sm.active {
+        ids = append(ids, id)
+    }
+    sm.sortStateIDs(ids)
+    return ids
+}
+
+// atomicStateIDs returns the ids of active states that have no sub states in
+// document order.
+func (sm *StateMachine) atomicStateIDs() []string{
+    var ids []string
+    for _, id := range sm.activeStateIDs() {
+        if !sm.isCompound(id) {
+            ids = append(ids, id)
+        }
+    }
+    return ids
+}
+
+// sortStateIDs sorts state ids in document order. A state is after its
+// ancestors and before its next sibling, the siblings are in the order of adding.
+func (sm *StateMachine) sortStateIDs(ids []string){
+    order := sm.documentOrder()
+    sort.Slice(ids, func(i, j int) bool{
+        return order[ids[i]] < order[ids[j]]
+    })
+}
+
+// documentOrder returns the document order of all states. It is computed
+// again after adding states.
+func (sm *StateMachine) documentOrder() map[string]int{
+    if sm.docOrder != nil { return sm.docOrder }
+
+    var tops []string
+    for id := range sm.states {
+        if _, ok := sm.parents[id]; !ok {
+            tops = append(tops, id)
+        }
+    }
+    sort.Slice(tops, func(i, j int) bool{
+        return sm.order[tops[i]] < sm.order[tops[j]]
+    })
+
+    sm.docOrder = make(map[string]int)
+    var walk func(id string)
+    walk = func(id string){
+        sm.docOrder[id] = len(sm.docOrder)
+        for _, c := range sm.children[id] {
+            walk(c)
+        }
+    }
+    for _, id := range tops {
+        walk(id)
+    }
+    return sm.docOrder
+}
+
+// isDescendant returns if one state is a proper descendant of another state.
+func (sm *StateMachine) isDescendant(id, ancestorID string) bool{
+    for p, ok := sm.parents[id]; ok; p, ok = sm.parents[p] {
+        if p == ancestorID { return true }
+    }
+    return false
+}
+
+// isCompound returns if the state has sub states.
+func (sm *StateMachine) isCompound(id string) bool{
+    return len(sm.children[id]) > 0
+}
+
+// initialSubStateID returns the id of the initial sub state of a compound state.
+func (sm *StateMachine) initialSubStateID(id string) string{
+    if initial, ok := sm.initialChildren[id]; ok {
+        return initial
+    }
+    return sm.children[id][0]
+}
+
+// transitionDomain returns the domain of a transition. For an internal
+// transition whose target is a descendant of its compound source state, the
+// domain is the source state. Otherwise it is the domain found by findDomain.
+func (sm *StateMachine) transitionDomain(t *transitionDef) string{
+    if t.transitionType == TRANSITION_INTERNAL && sm.isCompound(t.SourceID) && sm.isDescendant(t.TargetID, t.SourceID) {
+        return t.SourceID
+    }
+    return sm.findDomain(t.SourceID, t.TargetID)
+}
+
+// findDomain returns the domain of a transition. It is the nearest proper
+// ancestor of source state that is also a proper ancestor of target state
+// and is not a parallel state. An empty id means the domain is the state
+// machine itself.
+func (sm *StateMachine) findDomain(sourceID, targetID string) string{
+    for p, ok := sm.parents[sourceID]; ok; p, ok = sm.parents[p] {
+        if !sm.parallels[p] && sm.isDescendant(targetID, p) { return p }
+    }
+    return ""
+}
+
+// exitSet returns the ids of active states that should be exited by the
+// transitions, in the reverse document order.
+func (sm *StateMachine) exitSet(trans []*transitionDef) []string{
+    set := make(map[string]bool)
+    for _, t := range trans {
+        if t.isTargetless() { continue }
+        
+        domain := sm.transitionDomain(t)
+        for id := range sm.active {
+            if domain == "" || sm.isDescendant(id, domain) {
+                set[id] = true
+            }
+        }
+    }
+
+    ids := make([]string, 0, len(set))
+    for id := range set {
+        ids = append(ids, id)
+    }
+    sm.sortStateIDs(ids)
+    return reverseStateIDs(ids)
+}
+
+// reverseStateIDs reverses the order of state ids.
+func reverseStateIDs(ids []string) []string{
+    for i, j := 0, len(ids) - 1; i < j; i, j = i + 1, j - 1 {
+        ids[i], ids[j] = ids[j], ids[i]
+    }
+    return ids
+}
+
+// entrySet returns the ids of states that should be entered by the transitions,
+// in document order. They are the states from the domain to the targets, the
+// initial sub states of compound states and all sub states of parallel states.
+// If a target is a history pseudo-state, the remembered states replace it.
+func (sm *StateMachine) entrySet(trans []*transitionDef) []string{
+    set := make(map[string]bool)
+    domains := make([]string, len(trans))
+    targets := make([][]string, len(trans))
+    for i, t := range trans {
+        if t.isTargetless() { continue }
+        
+        domains[i] = sm.transitionDomain(t)
+        targets[i] = sm.resolveTarget(t.TargetID)
+        for _, id := range targets[i] {
+            sm.addDescendantsToEntrySet(id, set)
+        }
+    }
+    
+    // add ancestors after all targets, so that the regions having targets
+    // are not entered by default.
+    for i := range trans {
+        for _, id := range targets[i] {
+            sm.addAncestorsToEntrySet(id, domains[i], set)
+        }
+    }
+
+    ids := make([]string, 0, len(set))
+    for id := range set {
+        ids = append(ids, id)
+    }
+    sm.sortStateIDs(ids)
+    return ids
+}
+
+// addDescendantsToEntrySet adds the state and the sub states that should be
+// entered with it to the entry set.
+func (sm *StateMachine) addDescendantsToEntrySet(id string, set map[string]bool){
+    set[id] = true
+    if sm.parallels[id] {
+        sm.addRegionsToEntrySet(id, set)
+    }else if sm.isCompound(id) {
+        sm.addDescendantsToEntrySet(sm.initialSubStateID(id), set)
+    }
+}
+
+// addAncestorsToEntrySet adds the ancestors of the state under the domain to
+// the entry set.
+func (sm *StateMachine) addAncestorsToEntrySet(id, domain string, set map[string]bool){
+    for p, ok := sm.parents[id]; ok && p != domain; p, ok = sm.parents[p] {
+        set[p] = true
+        if sm.parallels[p] {
+            sm.addRegionsToEntrySet(p, set)
+        }
+    }
+}
+
+// addRegionsToEntrySet adds the regions of a parallel state that have no
+// state in the entry set yet.
+func (sm *StateMachine) addRegionsToEntrySet(id string, set map[string]bool){
+    for _, region := range sm.children[id] {
+        if !sm.hasDescendantInSet(region, set) {
+            sm.addDescendantsToEntrySet(region, set)
+        }
+    }
+}
+
+// hasDescendantInSet returns if the state or one of its descendants is in the set.
+func (sm *StateMachine) hasDescendantInSet(id string, set map[string]bool) bool{
+    for s := range set {
+        if s == id || sm.isDescendant(s, id) { return true }
+    }
+    return false
+}
+
+// isConflicting returns if two transitions exit at least one same state.
+func (sm *StateMachine) isConflicting(t1, t2 *transitionDef) bool{
+    exits := make(map[string]bool)
+    for _, id := range sm.exitSet([]*transitionDef{t1}) {
+        exits[id] = true
+    }
+    for _, id := range sm.exitSet([]*transitionDef{t2}) {
+        if exits[id] { return true }
+    }
+    return false
+}
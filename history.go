@@ -0,0 +1,108 @@
+package hackberry
+
+// The type of history pseudo-state
+const (
+    // The shallow history remembers the active sub state of its parent state.
+    HISTORY_SHALLOW = iota
+    
+    // The deep history remembers all active descendants of its parent state.
+    HISTORY_DEEP
+)
+
+// history is a pseudo-state of a compound state. When a transition targets it,
+// the state machine enters the states remembered last time exiting the compound
+// state, or the default target if there is no remembered states.
+type history struct{
+    // the id of the compound state
+    parentID string
+    
+    // HISTORY_SHALLOW or HISTORY_DEEP
+    historyType int
+    
+    // the id of the default target state
+    defaultTargetID string
+}
+
+// AddHistory adds a history pseudo-state to a compound state. The history's id
+// can be used as the target of transitions, but not a real state. historyType
+// is HISTORY_SHALLOW or HISTORY_DEEP. If there is no remembered states, the 
+// state machine enters the default target set by SetHistoryDefault, or the
+// compound state's initial sub state if no default target. The remembered
+// states are cleared when the state machine starts.
+func (sm *StateMachine) AddHistory(parentID, historyID string, historyType int) *StateMachine{
+    sm.checkMutable()
+    if sm.states[parentID] == nil {
+        panic(&ConfigError{Message: "Has no parent state [" + parentID + "]."})
+    }
+    if sm.isTarget(historyID) {
+        panic(&ConfigError{Message: "Duplicate state or history [" + historyID + "]."})
+    }
+    if historyType != HISTORY_SHALLOW && historyType != HISTORY_DEEP {
+        panic(&ConfigError{Message: "Unsupported history type of [" + historyID + "]."})
+    }
+    
+    sm.histories[historyID] = history{parentID, historyType, ""}
+    sm.parents[historyID] = parentID
+    return sm
+}
+
+// SetHistoryDefault sets the default target of a history pseudo-state. The
+// target should be a descendant of the history's parent state.
+func (sm *StateMachine) SetHistoryDefault(historyID, targetID string) *StateMachine{
+    sm.checkMutable()
+    h, ok := sm.histories[historyID]
+    if !ok {
+        panic(&ConfigError{Message: "Has no history [" + historyID + "]."})
+    }
+    if !sm.isDescendant(targetID, h.parentID) {
+        panic(&ConfigError{Message: "State [" + targetID + "] is not a descendant of [" + h.parentID + "]."})
+    }
+    
+    h.defaultTargetID = targetID
+    sm.histories[historyID] = h
+    return sm
+}
+
+// isTarget returns if the id is a state or a history pseudo-state.
+func (sm *StateMachine) isTarget(id string) bool{
+    _, ok := sm.histories[id]
+    return ok || sm.states[id] != nil
+}
+
+// recordHistory remembers the active sub states for histories of the state
+// before exiting it.
+func (sm *StateMachine) recordHistory(stateID string){
+    for id, h := range sm.histories {
+        if h.parentID != stateID { continue }
+        
+        var ids []string
+        for s := range sm.active {
+            if h.historyType == HISTORY_DEEP && !sm.isCompound(s) && sm.isDescendant(s, stateID) ||
+                h.historyType == HISTORY_SHALLOW && sm.parents[s] == stateID {
+                ids = append(ids, s)
+            }
+        }
+        sm.sortStateIDs(ids)
+        sm.historyValues[id] = ids
+    }
+}
+
+// resolveTarget returns the ids of states that a transition targets. For
+// history pseudo-state, they are the remembered states or the default target.
+func (sm *StateMachine) resolveTarget(targetID string) []string{
+    h, ok := sm.histories[targetID]
+    if !ok {
+        return []string{targetID}
+    }
+    
+    if ids := sm.historyValues[targetID]; len(ids) > 0 {
+        return ids
+    }
+    if h.defaultTargetID != "" {
+        return []string{h.defaultTargetID}
+    }
+    if sm.isCompound(h.parentID) {
+        return []string{sm.initialSubStateID(h.parentID)}
+    }
+    return []string{h.parentID}
+}
@@ -0,0 +1,409 @@
+package hackberry
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// The kind of journal entry
+const (
+    // The state machine starts and enters its initial states.
+    JOURNAL_START = "start"
+
+    // The state machine accepts an event and takes transitions.
+    JOURNAL_EVENT = "event"
+
+    // The state machine is stopped by Stop.
+    JOURNAL_STOP = "stop"
+)
+
+// Journal records what happened to a state machine, it is append-only. The
+// state machine can be rebuilt by replaying the entries of its journal.
+type Journal interface{
+    // Append appends an entry to the end of journal.
+    Append(entry *JournalEntry) error
+
+    // Entries returns all entries in the order of appending.
+    Entries() ([]*JournalEntry, error)
+}
+
+// JournalEntry is an entry of journal. An event entry is appended only if the
+// event is accepted, that is it takes transitions, and the entry includes all
+// transitions taken until the state machine is stable, include the eventless
+// transitions and the transitions of internal events.
+type JournalEntry struct{
+    // Seq is the sequence of entry, it begins with 1 and increases by 1.
+    Seq int64                       `json:"seq"`
+
+    // Time is the time of the clock of state machine when appending.
+    Time time.Time                  `json:"time"`
+
+    // Kind is JOURNAL_START, JOURNAL_EVENT or JOURNAL_STOP.
+    Kind string                     `json:"kind"`
+
+    // Event is the name of event of JOURNAL_EVENT entry.
+    Event string                    `json:"event,omitempty"`
+
+    // EventData is the data of a DataEvent encoded by the attribute codec.
+    EventData json.RawMessage       `json:"eventData,omitempty"`
+
+    // Steps are the transitions taken, the transitions of a step are taken
+    // together such as in parallel states.
+    Steps [][]JournalTransition     `json:"steps,omitempty"`
+
+    // Status is the status of state machine after the entry.
+    Status int                      `json:"status"`
+
+    // CurrentStateID is the id of the current state after the entry.
+    CurrentStateID string           `json:"currentState,omitempty"`
+
+    // Attributes are the context attributes after the entry encoded by the
+    // attribute codec. The actions are not executed when replaying, the
+    // attributes are set from them instead.
+    Attributes json.RawMessage      `json:"attributes,omitempty"`
+}
+
+// JournalTransition is a transition taken in a journal entry.
+type JournalTransition struct{
+    SourceID string     `json:"source,omitempty"`
+    TargetID string     `json:"target,omitempty"`
+    EventName string    `json:"event,omitempty"`
+    Type int            `json:"type,omitempty"`
+}
+
+// SetJournal sets the journal that state machine appends entries to. If the
+// journal has entries already, state machine should be rebuilt by Replay
+// first, so that the sequences of entries go on. If appending fails, the state
+// machine panics with the error like failing actions.
+func (sm *StateMachine) SetJournal(journal Journal) *StateMachine{
+    sm.journal = journal
+    sm.journalSeq = 0
+    return sm
+}
+
+// beginJournal begins an entry if there is a journal. Should lock before call
+// this method.
+func (sm *StateMachine) beginJournal(kind string, event Event){
+    if sm.journal == nil || sm.replaying { return }
+
+    e := &JournalEntry{Kind: kind}
+    if event != nil {
+        e.Event = event.Name()
+        if de, ok := event.(DataEvent); ok && len(de.Data()) > 0 {
+            data := make(map[Any]Any)
+            for k, v := range de.Data() {
+                data[k] = v
+            }
+            encoded, err := sm.attributeCodec.Encode(data)
+            if err != nil {
+                panic(err)
+            }
+            e.EventData = encoded
+        }
+    }
+    sm.journalEntry = e
+}
+
+// journalTransitions records the transitions of a step into the entry.
+func (sm *StateMachine) journalTransitions(trans []*transitionDef){
+    if sm.journalEntry == nil { return }
+
+    step := make([]JournalTransition, len(trans))
+    for i, t := range trans {
+        step[i] = JournalTransition{t.SourceID, t.TargetID, t.EventName, t.transitionType}
+    }
+    sm.journalEntry.Steps = append(sm.journalEntry.Steps, step)
+}
+
+// endJournal appends the entry to journal, an event entry is appended only if
+// it has transitions. Should lock before call this method.
+func (sm *StateMachine) endJournal(){
+    e := sm.journalEntry
+    if e == nil { return }
+    sm.journalEntry = nil
+    if e.Kind == JOURNAL_EVENT && len(e.Steps) == 0 { return }
+
+    attributes, err := sm.attributeCodec.Encode(sm.context.attributes)
+    if err != nil {
+        panic(err)
+    }
+    e.Seq = sm.journalSeq + 1
+    e.Time = sm.clock.Now()
+    e.Status = sm.runStatus
+    e.Attributes = attributes
+    if sm.currentState != nil {
+        e.CurrentStateID = sm.currentState.ID()
+    }
+    if err := sm.journal.Append(e); err != nil {
+        panic(err)
+    }
+    sm.journalSeq = e.Seq
+}
+
+// Replay rebuilds state machine by the entries of journal, it should be
+// configured like the one writing the journal. The transitions are taken again
+// without evaluating conditions and executing actions, listeners are not
+// notified, and the context attributes are set from the entries. The timers of
+// states are started when entering the states, as if the states are entered
+// now. If state machine has a journal, the following entries go on after the
+// entries replayed.
+func (sm *StateMachine) Replay(journal Journal) (err error){
+    entries, err := journal.Entries()
+    if err != nil {
+        return err
+    }
+    if err := sm.checkJournal(entries); err != nil {
+        return err
+    }
+
+    sm.process(func(){
+        defer catchError(&err)
+
+        sm.replaying = true
+        defer func(){
+            sm.replaying = false
+        }()
+        for _, e := range entries {
+            sm.replayEntry(e)
+        }
+        if len(entries) > 0 {
+            sm.journalSeq = entries[len(entries) - 1].Seq
+        }
+    })
+    return err
+}
+
+// checkJournal checks the sequences of entries, and that the states of their
+// transitions are configured, the targets may be history pseudo-states.
+func (sm *StateMachine) checkJournal(entries []*JournalEntry) error{
+    for i, e := range entries {
+        if i > 0 && e.Seq != entries[i - 1].Seq + 1 {
+            msg := fmt.Sprintf("Journal entry [%d] follows entry [%d].", e.Seq, entries[i - 1].Seq)
+            return &JournalError{Message: msg}
+        }
+        for _, step := range e.Steps {
+            for _, t := range step {
+                id := ""
+                switch {
+                    case t.SourceID != "" && sm.states[t.SourceID] == nil:
+                        id = t.SourceID
+                    case t.TargetID != "" && !sm.isTarget(t.TargetID):
+                        id = t.TargetID
+                    default:
+                        continue
+                }
+                msg := fmt.Sprintf("Has no state [%s] in journal entry [%d].", id, e.Seq)
+                return &JournalError{Message: msg}
+            }
+        }
+    }
+    return nil
+}
+
+// replayEntry takes the transitions of an entry and sets the status and the
+// attributes after it. Should lock before call this method.
+func (sm *StateMachine) replayEntry(e *JournalEntry){
+    if e.Kind == JOURNAL_START {
+        sm.reset()
+    }
+    for _, step := range e.Steps {
+        trans := make([]*transitionDef, len(step))
+        for i, t := range step {
+            tran := Transition{SourceID: t.SourceID, TargetID: t.TargetID, EventName: t.EventName}
+            trans[i] = &transitionDef{Transition: tran, transitionType: t.Type}
+        }
+        sm.transitState(nil, trans)
+    }
+    if e.Kind == JOURNAL_START {
+        sm.setRunStatus(STATUS_RUNNING)
+    }
+    if e.Status != STATUS_RUNNING && sm.IsRunning() {
+        sm.stop(e.Status)
+    }
+    sm.clearInternalEvents()
+    sm.setEvent(nil)
+
+    attributes := make(map[Any]Any)
+    if len(e.Attributes) > 0 {
+        var err error
+        if attributes, err = sm.attributeCodec.Decode(e.Attributes); err != nil {
+            panic(err)
+        }
+    }
+    for k := range sm.context.attributes {
+        delete(sm.context.attributes, k)
+    }
+    for k, v := range attributes {
+        sm.context.attributes[k] = v
+    }
+}
+
+// memoryJournal implements Journal in memory.
+type memoryJournal struct{
+    entries []*JournalEntry
+    locker sync.Mutex
+}
+
+// NewMemoryJournal creates a journal that keeps entries in memory.
+func NewMemoryJournal() Journal{
+    return &memoryJournal{}
+}
+
+func (j *memoryJournal) Append(entry *JournalEntry) error{
+    j.locker.Lock()
+    defer j.locker.Unlock()
+
+    j.entries = append(j.entries, entry)
+    return nil
+}
+
+func (j *memoryJournal) Entries() ([]*JournalEntry, error){
+    j.locker.Lock()
+    defer j.locker.Unlock()
+
+    return append([]*JournalEntry(nil), j.entries...), nil
+}
+
+// fileJournal implements Journal by a file of newline-delimited json.
+type fileJournal struct{
+    path string
+    locker sync.Mutex
+
+    // if the last line left by a crash is cut off before appending.
+    repaired bool
+}
+
+// journalLine is a line of journal file, the checksum is the crc32 of entry.
+type journalLine struct{
+    Checksum string          `json:"crc"`
+    Entry json.RawMessage    `json:"entry"`
+}
+
+// NewFileJournal creates a journal that appends entries to a file, each line
+// is an entry in json with its checksum. The file is created if it doesn't
+// exist, and it is synced after each appending.
+func NewFileJournal(path string) Journal{
+    return &fileJournal{path: path}
+}
+
+func (j *fileJournal) Append(entry *JournalEntry) error{
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return &JournalError{Message: "Can't encode journal entry.", Cause: err}
+    }
+    line, err := json.Marshal(&journalLine{checksum(data), data})
+    if err != nil {
+        return &JournalError{Message: "Can't encode journal entry.", Cause: err}
+    }
+
+    j.locker.Lock()
+    defer j.locker.Unlock()
+
+    if !j.repaired {
+        if err := j.repair(); err != nil {
+            return err
+        }
+        j.repaired = true
+    }
+
+    f, err := os.OpenFile(j.path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+    if err != nil {
+        return &JournalError{Message: "Can't open journal [" + j.path + "].", Cause: err}
+    }
+    defer f.Close()
+
+    if _, err := f.Write(append(line, '\n')); err != nil {
+        // the line may be written partly
+        j.repaired = false
+        return &JournalError{Message: "Can't write journal [" + j.path + "].", Cause: err}
+    }
+    if err := f.Sync(); err != nil {
+        return &JournalError{Message: "Can't write journal [" + j.path + "].", Cause: err}
+    }
+    return nil
+}
+
+// repair cuts off the last line without newline, which is left by a crash when
+// appending, so that the next entry is not appended to it. Should lock before
+// call this method.
+func (j *fileJournal) repair() error{
+    content, err := os.ReadFile(j.path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return &JournalError{Message: "Can't read journal [" + j.path + "].", Cause: err}
+    }
+    if len(content) == 0 || content[len(content) - 1] == '\n' {
+        return nil
+    }
+
+    size := bytes.LastIndexByte(content, '\n') + 1
+    if err := os.Truncate(j.path, int64(size)); err != nil {
+        return &JournalError{Message: "Can't truncate journal [" + j.path + "].", Cause: err}
+    }
+    return nil
+}
+
+// Entries reads the entries from file, and checks their checksums. It returns
+// a JournalError if a line is broken. An entry is appended only when its line
+// and the newline are written, so the last line without newline is left by a
+// crash when appending, it is skipped, and cut off by the next Append.
+func (j *fileJournal) Entries() ([]*JournalEntry, error){
+    j.locker.Lock()
+    defer j.locker.Unlock()
+
+    content, err := os.ReadFile(j.path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, &JournalError{Message: "Can't read journal [" + j.path + "].", Cause: err}
+    }
+
+    var entries []*JournalEntry
+    offset := 0
+    for n := 1; offset < len(content); n++ {
+        i := bytes.IndexByte(content[offset:], '\n')
+        if i < 0 { break }
+
+        data := content[offset:offset + i]
+        e, err := j.parseLine(n, data)
+        if err != nil {
+            return nil, err
+        }
+        entries = append(entries, e)
+        offset += len(data) + 1
+    }
+    return entries, nil
+}
+
+// parseLine parses the line n of journal file and checks its checksum.
+func (j *fileJournal) parseLine(n int, data []byte) (*JournalEntry, error){
+    msg := "Broken line [" + strconv.Itoa(n) + "] of journal [" + j.path + "]."
+    var line journalLine
+    if err := json.Unmarshal(data, &line); err != nil {
+        return nil, &JournalError{Message: msg, Cause: err}
+    }
+    if line.Checksum != checksum(line.Entry) {
+        msg = "Checksum of line [" + strconv.Itoa(n) + "] of journal [" + j.path + "] mismatches."
+        return nil, &JournalError{Message: msg}
+    }
+
+    e := &JournalEntry{}
+    if err := json.Unmarshal(line.Entry, e); err != nil {
+        return nil, &JournalError{Message: msg, Cause: err}
+    }
+    return e, nil
+}
+
+// checksum returns the crc32 of data in hex.
+func checksum(data []byte) string{
+    return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
@@ -0,0 +1,145 @@
+package hackberry
+
+// Listener observes the state machine, such as for audit logging and metrics.
+// All callbacks are called while the state machine holds its locker. So the
+// callbacks can call SendEvent and Raise, the events are queued, but must not
+// call Start, Stop and SendEventWithResult, which wait for the locker. If a
+// callback panics, the state machine panics as an action does.
+type Listener interface{
+    // OnStarted is called after the state machine starts and enters its
+    // initial states, before processing the internal events raised then.
+    OnStarted(c *Context)
+
+    // OnStopped is called after the state machine exits all states, status is
+    // STATUS_STOPPED or STATUS_FINISHED.
+    OnStopped(c *Context, status int)
+
+    // BeforeTransition is called before exiting states for each transition
+    // taken. event is the event processing, it is nil when starting.
+    BeforeTransition(c *Context, event Event, t Transition)
+
+    // AfterTransition is called after entering states for each transition taken.
+    AfterTransition(c *Context, event Event, t Transition)
+
+    // OnStateEntered is called after the entry actions of a state are executed.
+    OnStateEntered(c *Context, state State)
+
+    // OnStateExited is called after the exit actions of a state are executed.
+    OnStateExited(c *Context, state State)
+
+    // OnEventIgnored is called when an event sent to or raised by the state
+    // machine is dropped, reason is RESULT_NOT_RUNNING, RESULT_NO_TRANSITION or
+    // RESULT_GUARDS_FALSE. Deferred events are not ignored.
+    OnEventIgnored(c *Context, event Event, reason int)
+
+    // OnGuardEvaluated is called after a transition condition is evaluated, err
+    // is the error occurred on evaluating.
+    OnGuardEvaluated(c *Context, t Transition, satisfied bool, err error)
+
+    // OnActionFailed is called when an action panics, before the panic goes on.
+    OnActionFailed(c *Context, a Action, err error)
+
+    // OnTimeout is called when the timeout or a named timer of a state fires,
+    // before its event is processed. Timers cancelled are not notified.
+    OnTimeout(c *Context, state State, event Event)
+
+    // OnEventFailed is called when processing an event panics and its sender
+    // doesn't wait for it, such as the events queued while another goroutine is
+    // processing, the events of timers and SendEventAfter, and the deferred
+    // events. A panic of this callback is discarded.
+    OnEventFailed(c *Context, event Event, err error)
+}
+
+// DefaultListener implements Listener with methods doing nothing. It can be
+// embedded in a listener that only needs some of the callbacks.
+type DefaultListener struct{
+}
+
+func (l *DefaultListener) OnStarted(c *Context){}
+
+func (l *DefaultListener) OnStopped(c *Context, status int){}
+
+func (l *DefaultListener) BeforeTransition(c *Context, event Event, t Transition){}
+
+func (l *DefaultListener) AfterTransition(c *Context, event Event, t Transition){}
+
+func (l *DefaultListener) OnStateEntered(c *Context, state State){}
+
+func (l *DefaultListener) OnStateExited(c *Context, state State){}
+
+func (l *DefaultListener) OnEventIgnored(c *Context, event Event, reason int){}
+
+func (l *DefaultListener) OnGuardEvaluated(c *Context, t Transition, satisfied bool, err error){}
+
+func (l *DefaultListener) OnActionFailed(c *Context, a Action, err error){}
+
+func (l *DefaultListener) OnTimeout(c *Context, state State, event Event){}
+
+func (l *DefaultListener) OnEventFailed(c *Context, event Event, err error){}
+
+// AddListener adds a listener to the state machine. Listeners are called in
+// the order of adding. It should be called before starting state machine.
+func (sm *StateMachine) AddListener(l Listener) *StateMachine{
+    sm.listeners = append(sm.listeners, l)
+    return sm
+}
+
+// RemoveListener removes a listener from the state machine. It should not be
+// called while the state machine is running.
+func (sm *StateMachine) RemoveListener(l Listener) *StateMachine{
+    for i, o := range sm.listeners {
+        if o == l {
+            sm.listeners = append(sm.listeners[:i:i], sm.listeners[i+1:]...)
+            break
+        }
+    }
+    return sm
+}
+
+// notify calls f with each listener. Listeners are not notified when replaying
+// a journal.
+func (sm *StateMachine) notify(f func(l Listener)){
+    if sm.replaying { return }
+    for _, l := range sm.listeners {
+        f(l)
+    }
+}
+
+// notifyIgnored notifies listeners that an event is ignored. The reason is
+// RESULT_GUARDS_FALSE if a transition of active states matches the event.
+func (sm *StateMachine) notifyIgnored(event Event, running bool){
+    if len(sm.listeners) == 0 { return }
+
+    reason := RESULT_NOT_RUNNING
+    if running {
+        reason = RESULT_NO_TRANSITION
+        if sm.hasMatchedTransition(event) {
+            reason = RESULT_GUARDS_FALSE
+        }
+    }
+    sm.notify(func(l Listener){
+        l.OnEventIgnored(&sm.context, event, reason)
+    })
+}
+
+// notifyFailed notifies listeners that processing an event panics. The panics
+// of listeners are discarded, because it may be called by clock goroutines,
+// which have no one to recover them.
+func (sm *StateMachine) notifyFailed(event Event, failure Any){
+    err := panicError(failure)
+    sm.notify(func(l Listener){
+        defer func(){ recover() }()
+        l.OnEventFailed(&sm.context, event, err)
+    })
+}
+
+// hasMatchedTransition returns if a transition of active states matches the
+// event, whether its condition is satisfied or not.
+func (sm *StateMachine) hasMatchedTransition(event Event) bool{
+    for id := range sm.active {
+        for _, t := range sm.transitions[id] {
+            if matchEvent(t.EventName, event.Name()) { return true }
+        }
+    }
+    return false
+}
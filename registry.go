@@ -0,0 +1,551 @@
+package hackberry
+
+import (
+    "errors"
+    "hash/fnv"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// DEFAULT_REGISTRY_SHARDS is the default number of shards of registry.
+const DEFAULT_REGISTRY_SHARDS = 32
+
+// errNotIdle cancels passivating a state machine that is active again or not
+// running.
+var errNotIdle = errors.New("state machine is not idle")
+
+// Registry manages the state machines of a definition by their ids, and routes
+// events to them. The ids are divided into shards by hash, each shard has its
+// own locker, so the state machines of different shards never contend. The
+// locker of shard is not held while processing events, or while reading and
+// writing the store.
+//
+// With passivation, the state machines idle for a while are saved to a store
+// and evicted from memory, they are loaded again when they are needed.
+type Registry struct{
+    def *Definition
+    shards []*registryShard
+
+    // the function to set up a state machine before starting or restoring it
+    initializer func(id string, sm *StateMachine)
+
+    // the clock of registry and its state machines
+    clock Clock
+
+    // the store that idle state machines are saved to, and the idle time
+    store Store
+    idle time.Duration
+
+    // the timer to passivate idle state machines
+    sweeper Timer
+    sweeperLocker sync.Mutex
+}
+
+// registryShard is a shard of registry.
+type registryShard struct{
+    entries map[string]*registryEntry
+
+    // the state machines being created or loaded, the channel is closed when
+    // it is done. The shard is not locked while creating and loading.
+    loading map[string]chan struct{}
+
+    // the timers to wake up the passivated state machines having timers
+    wakeups map[string]Timer
+
+    locker sync.RWMutex
+}
+
+// registryEntry is a state machine in memory.
+type registryEntry struct{
+    sm *StateMachine
+
+    // the version of its snapshot in store, 0 if it is not saved.
+    version int64
+
+    // the time of the last event sent or creating in unix nanoseconds.
+    lastActive int64
+
+    // it is read locked while sending events, and locked while passivating.
+    locker sync.RWMutex
+}
+
+// NewRegistry creates a registry of the definition with DEFAULT_REGISTRY_SHARDS
+// shards.
+func NewRegistry(def *Definition) *Registry{
+    return NewRegistryShards(def, DEFAULT_REGISTRY_SHARDS)
+}
+
+// NewRegistryShards creates a registry of the definition with n shards. If n is
+// less than one, the registry has one shard.
+func NewRegistryShards(def *Definition, n int) *Registry{
+    if n < 1 {
+        n = 1
+    }
+
+    r := &Registry{def: def, shards: make([]*registryShard, n), clock: defaultClock}
+    for i := range r.shards {
+        r.shards[i] = &registryShard{entries: make(map[string]*registryEntry),
+            loading: make(map[string]chan struct{}), wakeups: make(map[string]Timer)}
+    }
+    return r
+}
+
+// SetInitializer sets the function to set up each state machine created or
+// loaded from store, such as setting its listeners and context attributes. It
+// is called before the state machine starts or is restored.
+func (r *Registry) SetInitializer(f func(id string, sm *StateMachine)) *Registry{
+    r.initializer = f
+    return r
+}
+
+// SetClock sets the clock of registry, it is set to the state machines created
+// too. It should be set before creating state machines and SetPassivation.
+func (r *Registry) SetClock(clock Clock) *Registry{
+    r.clock = clock
+    return r
+}
+
+// SetPassivation enables passivation. The running state machines that no event
+// is sent to for the idle time are saved to the store and evicted from memory,
+// the stopped and finished ones are kept for RemoveFinished and queries. The
+// idle ones are checked every idle time. When an event is sent to an evicted
+// state machine, it is loaded from the store transparently. The timers of state
+// machines are started again with their remaining time, an evicted state
+// machine is loaded when its first timer is due. The state machines having
+// events scheduled by SendEventAfter or deferred are not evicted until the
+// events are processed. An evicted state machine returned by Create or Get
+// before keeps its state, but refuses events with ErrEvicted, it should be got
+// from the registry again. Close stops the passivation.
+func (r *Registry) SetPassivation(store Store, idle time.Duration) *Registry{
+    if idle <= 0 {
+        panic(&ConfigError{Message: "Idle time of passivation should be greater than zero."})
+    }
+
+    r.store = store
+    r.idle = idle
+    r.scheduleSweeper()
+    return r
+}
+
+// Close stops the passivation, and the timers to load the evicted state
+// machines. The state machines in memory are not changed.
+func (r *Registry) Close(){
+    r.sweeperLocker.Lock()
+    if r.sweeper != nil {
+        r.sweeper.Stop()
+        r.sweeper = nil
+    }
+    r.sweeperLocker.Unlock()
+
+    for _, s := range r.shards {
+        s.locker.Lock()
+        for id, t := range s.wakeups {
+            t.Stop()
+            delete(s.wakeups, id)
+        }
+        s.locker.Unlock()
+    }
+}
+
+// scheduleSweeper schedules passivating idle state machines after idle time.
+func (r *Registry) scheduleSweeper(){
+    r.sweeperLocker.Lock()
+    defer r.sweeperLocker.Unlock()
+
+    if r.sweeper != nil {
+        r.sweeper.Stop()
+    }
+    var t Timer
+    t = r.clock.AfterFunc(r.idle, func(){
+        r.PassivateIdle()
+
+        r.sweeperLocker.Lock()
+        current := r.sweeper == t
+        r.sweeperLocker.Unlock()
+        if current {
+            r.scheduleSweeper()
+        }
+    })
+    r.sweeper = t
+}
+
+// shard returns the shard of id.
+func (r *Registry) shard(id string) *registryShard{
+    h := fnv.New32a()
+    h.Write([]byte(id))
+    return r.shards[h.Sum32() % uint32(len(r.shards))]
+}
+
+// newStateMachine creates a state machine of id, and sets it up.
+func (r *Registry) newStateMachine(id string) *StateMachine{
+    sm := r.def.NewStateMachine()
+    sm.SetClock(r.clock)
+    if r.initializer != nil {
+        r.initializer(id, sm)
+    }
+    return sm
+}
+
+// Create creates a state machine of id and starts it. It returns
+// ErrMachineExists if there is one of id already, include the one evicted to
+// store, or returns the error of starting. The state machine is added before
+// starting, the events sent to it before starting get ErrNotRunning.
+func (r *Registry) Create(id string) (*StateMachine, error){
+    s := r.shard(id)
+    s.lockIdle(id)
+    if s.entries[id] != nil || s.wakeups[id] != nil {
+        s.locker.Unlock()
+        return nil, ErrMachineExists
+    }
+    s.loading[id] = make(chan struct{})
+    s.locker.Unlock()
+
+    e, err := r.create(s, id)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := e.sm.TryStart(); err != nil {
+        r.remove(id, e)
+        return nil, err
+    }
+    return e.sm, nil
+}
+
+// create creates the entry of a new state machine of id, and adds it to the
+// shard. It returns ErrMachineExists if there is one of id in store.
+func (r *Registry) create(s *registryShard, id string) (e *registryEntry, err error){
+    defer func(){
+        s.loaded(id, e)
+    }()
+
+    if r.store != nil {
+        if _, _, err := r.store.Load(id); err != ErrNotFound {
+            if err == nil {
+                err = ErrMachineExists
+            }
+            return nil, err
+        }
+    }
+    return &registryEntry{sm: r.newStateMachine(id), lastActive: r.clock.Now().UnixNano()}, nil
+}
+
+// Get returns the state machine of id, it is loaded from store if it is
+// evicted. It returns nil if there is no one.
+func (r *Registry) Get(id string) *StateMachine{
+    e, _ := r.entry(id)
+    if e == nil {
+        return nil
+    }
+    return e.sm
+}
+
+// entry returns the entry of id in memory, or loads it from store. A state
+// machine is loaded once, the others needing it wait for the loading, but the
+// shard is not locked meanwhile.
+func (r *Registry) entry(id string) (*registryEntry, error){
+    s := r.shard(id)
+    s.locker.RLock()
+    e := s.entries[id]
+    s.locker.RUnlock()
+    if e != nil {
+        return e, nil
+    }
+
+    s.lockIdle(id)
+    if e := s.entries[id]; e != nil || r.store == nil {
+        s.locker.Unlock()
+        return e, nil
+    }
+    s.loading[id] = make(chan struct{})
+    s.locker.Unlock()
+
+    return r.load(s, id)
+}
+
+// load loads the entry of id from store and adds it to the shard, it returns
+// nil if there is no one.
+func (r *Registry) load(s *registryShard, id string) (e *registryEntry, err error){
+    defer func(){
+        s.loaded(id, e)
+    }()
+
+    data, version, err := r.store.Load(id)
+    if err == ErrNotFound {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    sm := r.newStateMachine(id)
+    if err := sm.resume(data); err != nil {
+        return nil, err
+    }
+    return &registryEntry{sm: sm, version: version, lastActive: r.clock.Now().UnixNano()}, nil
+}
+
+// lockIdle locks the shard when the state machine of id is not being created
+// or loaded, it waits for them first.
+func (s *registryShard) lockIdle(id string){
+    for {
+        s.locker.Lock()
+        done := s.loading[id]
+        if done == nil {
+            return
+        }
+        s.locker.Unlock()
+        <-done
+    }
+}
+
+// loaded adds the entry created or loaded of id if it is not nil, and wakes up
+// the ones waiting for it. It is called even if creating or loading panics.
+func (s *registryShard) loaded(id string, e *registryEntry){
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    if e != nil {
+        s.entries[id] = e
+        if t := s.wakeups[id]; t != nil {
+            t.Stop()
+            delete(s.wakeups, id)
+        }
+    }
+    close(s.loading[id])
+    delete(s.loading, id)
+}
+
+// Send sends the event to the state machine of id like TrySendEvent, it is
+// loaded from store if it is evicted. It returns ErrMachineNotFound if there
+// is no state machine of id.
+func (r *Registry) Send(id string, event Event) error{
+    for {
+        e, err := r.entry(id)
+        if err != nil {
+            return err
+        }
+        if e == nil {
+            return ErrMachineNotFound
+        }
+
+        e.locker.RLock()
+        atomic.StoreInt64(&e.lastActive, r.clock.Now().UnixNano())
+        err = e.sm.TrySendEvent(event)
+        e.locker.RUnlock()
+
+        // it is evicted just now, send to the one loaded again
+        if err == ErrEvicted {
+            continue
+        }
+        return err
+    }
+}
+
+// Remove stops the state machine of id and removes it, and deletes its
+// snapshot from store. It returns ErrMachineNotFound if there is no one, or the
+// error of loading or deleting the snapshot.
+func (r *Registry) Remove(id string) error{
+    e, err := r.entry(id)
+    if err != nil {
+        return err
+    }
+    if e == nil || !r.remove(id, e) {
+        return ErrMachineNotFound
+    }
+    if e.sm.IsRunning() {
+        e.sm.TryStop()
+    }
+    return r.deleteSnapshot(id, e)
+}
+
+// remove removes the entry of id if it is e.
+func (r *Registry) remove(id string, e *registryEntry) bool{
+    s := r.shard(id)
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    if s.entries[id] != e {
+        return false
+    }
+    delete(s.entries, id)
+    return true
+}
+
+// deleteSnapshot deletes the snapshot of the entry removed from store if it is
+// saved. It is called without locking the shard.
+func (r *Registry) deleteSnapshot(id string, e *registryEntry) error{
+    if r.store == nil || e.version == 0 {
+        return nil
+    }
+    if err := r.store.Delete(id, e.version); err != nil && err != ErrNotFound {
+        return err
+    }
+    return nil
+}
+
+// Len returns the number of state machines in memory.
+func (r *Registry) Len() int{
+    n := 0
+    for _, s := range r.shards {
+        s.locker.RLock()
+        n += len(s.entries)
+        s.locker.RUnlock()
+    }
+    return n
+}
+
+// IDs returns the ids of all state machines in memory in order.
+func (r *Registry) IDs() []string{
+    return r.find(func(sm *StateMachine) bool{
+        return true
+    })
+}
+
+// FindInState returns the ids of state machines in memory that are in the
+// state in order, that is the state is one of their active states.
+func (r *Registry) FindInState(stateID string) []string{
+    return r.find(func(sm *StateMachine) bool{
+        return sm.IsInState(stateID)
+    })
+}
+
+// RemoveFinished removes the state machines in memory that finished by entering
+// a top level final state, and returns their ids in order. Their snapshots are
+// deleted from store after removing, the first error of deleting is returned.
+func (r *Registry) RemoveFinished() ([]string, error){
+    removed := make(map[string]*registryEntry)
+    for _, s := range r.shards {
+        s.locker.Lock()
+        for id, e := range s.entries {
+            if e.sm.IsFinished() {
+                delete(s.entries, id)
+                removed[id] = e
+            }
+        }
+        s.locker.Unlock()
+    }
+
+    var ids []string
+    var first error
+    for id, e := range removed {
+        if err := r.deleteSnapshot(id, e); err != nil && first == nil {
+            first = err
+        }
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids, first
+}
+
+// find returns the ids of state machines matching f in order. Each shard is
+// locked in turn, so it doesn't block other shards.
+func (r *Registry) find(f func(sm *StateMachine) bool) []string{
+    var ids []string
+    for _, s := range r.shards {
+        s.locker.RLock()
+        for id, e := range s.entries {
+            if f(e.sm) {
+                ids = append(ids, id)
+            }
+        }
+        s.locker.RUnlock()
+    }
+    sort.Strings(ids)
+    return ids
+}
+
+// PassivateIdle saves the state machines idle for the idle time of passivation
+// to store and evicts them, and returns their ids in order. It is called every
+// idle time after SetPassivation, and can be called to passivate at once. The
+// state machines that events are being sent to are not idle, and those not
+// running or having events scheduled or deferred are never evicted. If a state
+// machine can't be saved, it is kept in memory, and the first error is returned.
+func (r *Registry) PassivateIdle() ([]string, error){
+    if r.store == nil {
+        return nil, nil
+    }
+
+    var ids []string
+    var first error
+    deadline := r.clock.Now().Add(-r.idle).UnixNano()
+    for _, s := range r.shards {
+        s.locker.RLock()
+        idles := make(map[string]*registryEntry)
+        for id, e := range s.entries {
+            if atomic.LoadInt64(&e.lastActive) <= deadline && e.sm.IsRunning() {
+                idles[id] = e
+            }
+        }
+        s.locker.RUnlock()
+
+        for id, e := range idles {
+            ok, err := r.passivate(s, id, e, deadline)
+            if err != nil && first == nil {
+                first = err
+            }
+            if ok {
+                ids = append(ids, id)
+            }
+        }
+    }
+    sort.Strings(ids)
+    return ids, first
+}
+
+// passivate saves the state machine of entry to store and evicts it, if it is
+// still idle. If it has timers running, it is loaded again when the first timer
+// is due. The shard is not locked while waiting for the state machine, because
+// its actions may send events by the registry, and while saving to or deleting
+// from store.
+func (r *Registry) passivate(s *registryShard, id string, e *registryEntry, deadline int64) (bool, error){
+    if !e.locker.TryLock() {
+        return false, nil
+    }
+    defer e.locker.Unlock()
+
+    ok := false
+    err := e.sm.suspend(func(data []byte, next time.Duration, hasNext bool) error{
+        // no event is sent while the entry is locked, it is idle still after
+        // checking
+        s.locker.RLock()
+        idle := s.entries[id] == e && atomic.LoadInt64(&e.lastActive) <= deadline
+        s.locker.RUnlock()
+        if !idle || !e.sm.IsRunning() {
+            return errNotIdle
+        }
+        version, err := r.store.Save(id, data, e.version)
+        if err != nil {
+            return err
+        }
+
+        s.locker.Lock()
+        removed := s.entries[id] != e
+        if !removed {
+            delete(s.entries, id)
+            if hasNext {
+                s.wakeups[id] = r.clock.AfterFunc(next, func(){
+                    r.entry(id)
+                })
+            }
+            e.version = version
+            ok = true
+        }
+        s.locker.Unlock()
+
+        // it is removed while saving, the snapshot saved is deleted again
+        if removed {
+            if err := r.store.Delete(id, version); err != nil && err != ErrNotFound {
+                return err
+            }
+            return errNotIdle
+        }
+        return nil
+    })
+    if err == errNotIdle {
+        err = nil
+    }
+    return ok, err
+}
@@ -0,0 +1,143 @@
+package hackberry
+
+// The status of EventResult.
+const (
+    // The event enabled transitions and they are taken.
+    RESULT_TRANSITED = iota
+
+    // The state machine is not running, the event is ignored.
+    RESULT_NOT_RUNNING
+
+    // No transition of active states matches the event, it is ignored.
+    RESULT_NO_TRANSITION
+
+    // Transitions match the event, but their conditions are not satisfied.
+    RESULT_GUARDS_FALSE
+
+    // No transition is enabled, and the event is deferred by an active state.
+    RESULT_DEFERRED
+
+    // An error occurred on processing the event, it is in EventResult.Err.
+    RESULT_FAILED
+)
+
+// EventResult describes what happened when state machine processed an event.
+// Only the transitions of the event itself are described, not the eventless
+// transitions and internal events processed after them.
+type EventResult struct{
+    // the processed event
+    Event Event
+
+    // one of RESULT_TRANSITED, RESULT_NOT_RUNNING, RESULT_NO_TRANSITION,
+    // RESULT_GUARDS_FALSE, RESULT_DEFERRED and RESULT_FAILED.
+    Status int
+
+    // the transitions taken, in the order of executing their actions.
+    Transitions []TransitionResult
+
+    // the conditions evaluated when selecting transitions, in order.
+    Guards []GuardResult
+
+    // the exit, transition and entry actions executed, in order.
+    Actions []ActionResult
+
+    // the error occurred on processing the event. The errors of the queued
+    // and deferred events processed after it are reported to their senders or
+    // listeners, not here.
+    Err error
+}
+
+// TransitionResult describes a transition taken.
+type TransitionResult struct{
+    Transition Transition
+
+    // the source state of transition.
+    Source State
+
+    // the target state of transition. It is nil if the transition has no
+    // target or its target is a history pseudo-state.
+    Target State
+}
+
+// GuardResult describes a condition evaluated.
+type GuardResult struct{
+    // the transition having the condition.
+    Transition Transition
+
+    // if the condition is satisfied.
+    Satisfied bool
+
+    // the error occurred on evaluating the condition.
+    Err error
+}
+
+// ActionResult describes an action executed.
+type ActionResult struct{
+    Action Action
+
+    // the error occurred on executing the action. The state machine stops
+    // processing the event after an action fails.
+    Err error
+}
+
+// SendEventWithResult is like SendEvent, but waits until the event is processed
+// and returns what happened. It never panics, the error of processing the event
+// is in the result. The events queued by other goroutines may be processed
+// after it, their errors are not in the result. It should not be called in
+// actions, because the event can't be processed before the current event is
+// finished, use Raise or SendEvent instead.
+func (sm *StateMachine) SendEventWithResult(event Event) (r *EventResult){
+    r = &EventResult{Event: event, Status: RESULT_NOT_RUNNING}
+    defer func(){
+        if r.Err != nil {
+            r.Status = RESULT_FAILED
+        }
+    }()
+    defer catchError(&r.Err)
+
+    sm.process(func(){
+        sm.processEventResult(event, r)
+    })
+    return r
+}
+
+// processEventResult processes an event like processEvent, and records what
+// happened into the result. Should lock before call this method.
+func (sm *StateMachine) processEventResult(event Event, r *EventResult){
+    if event == nil { return }
+    
+    // ignored like SendEvent, listeners are notified
+    if !sm.IsRunning() {
+        sm.offerEvent(event)
+        return
+    }
+
+    deferred := len(sm.deferredEvents)
+    sm.result = r
+    defer func(){
+        sm.result = nil
+    }()
+    sm.offerEvent(event)
+
+    switch {
+        case len(r.Transitions) > 0:
+            r.Status = RESULT_TRANSITED
+        case len(sm.deferredEvents) > deferred:
+            r.Status = RESULT_DEFERRED
+        case len(r.Guards) > 0:
+            r.Status = RESULT_GUARDS_FALSE
+        default:
+            r.Status = RESULT_NO_TRANSITION
+    }
+    sm.processDeferredEvents()
+}
+
+// recordTransitions records the transitions taken if there is a result recording.
+func (sm *StateMachine) recordTransitions(trans []*transitionDef){
+    if sm.result == nil { return }
+
+    for _, t := range trans {
+        sm.result.Transitions = append(sm.result.Transitions,
+            TransitionResult{t.Transition, sm.states[t.SourceID], sm.states[t.TargetID]})
+    }
+}
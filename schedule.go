@@ -0,0 +1,83 @@
+package hackberry
+
+import (
+    "strconv"
+    "time"
+)
+
+// The prefix of ids of scheduled events.
+const SCHEDULED_ID_PREFIX = "scheduled."
+
+// scheduledEvent is an event to be sent after a delay.
+type scheduledEvent struct{
+    id string
+    event Event
+
+    // the timer created by clock
+    handle Timer
+}
+
+// SendEventAfter sends the event to state machine after the delay, and returns
+// an id to cancel it by CancelScheduled. The event is sent like SendEvent then,
+// so it is processed in order with other events, and is ignored if the state
+// machine is not running. The panic of processing it is reported to listeners
+// by OnEventFailed. It uses the clock of state machine, and can be called
+// in actions. All scheduled events are cancelled when the state machine stops.
+func (sm *StateMachine) SendEventAfter(event Event, delay time.Duration) string{
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+
+    sm.scheduledSeq++
+    s := &scheduledEvent{id: SCHEDULED_ID_PREFIX + strconv.Itoa(sm.scheduledSeq), event: event}
+    sm.scheduled[s.id] = s
+    s.handle = sm.clock.AfterFunc(delay, func(){
+        sm.sendScheduled(s)
+    })
+    return s.id
+}
+
+// CancelScheduled cancels a scheduled event by its id. It returns false if the
+// event has been sent or cancelled already.
+func (sm *StateMachine) CancelScheduled(id string) bool{
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+
+    s, ok := sm.scheduled[id]
+    if !ok { return false }
+
+    s.handle.Stop()
+    delete(sm.scheduled, id)
+    return true
+}
+
+// hasScheduled returns if there are events scheduled and not sent yet.
+func (sm *StateMachine) hasScheduled() bool{
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+
+    return len(sm.scheduled) > 0
+}
+
+// cancelAllScheduled cancels all scheduled events.
+func (sm *StateMachine) cancelAllScheduled(){
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+
+    for id, s := range sm.scheduled {
+        s.handle.Stop()
+        delete(sm.scheduled, id)
+    }
+}
+
+// sendScheduled is called by clock to send a scheduled event, if it is not
+// cancelled yet.
+func (sm *StateMachine) sendScheduled(s *scheduledEvent){
+    sm.queueLocker.Lock()
+    ok := sm.scheduled[s.id] == s
+    delete(sm.scheduled, s.id)
+    sm.queueLocker.Unlock()
+
+    if ok {
+        sm.post(s.event)
+    }
+}
@@ -0,0 +1,315 @@
+package hackberry
+
+import (
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+// SNAPSHOT_VERSION is the version of the snapshot format. Restore refuses the
+// snapshots of other versions.
+const SNAPSHOT_VERSION = 1
+
+// snapshot defines the json form of a snapshot.
+type snapshot struct{
+    Version int                         `json:"version"`
+    Time time.Time                      `json:"time"`
+    Status int                          `json:"status"`
+    CurrentStateID string               `json:"currentState,omitempty"`
+    PreviousStateID string              `json:"previousState,omitempty"`
+    ActiveStateIDs []string             `json:"activeStates,omitempty"`
+    HistoryValues map[string][]string   `json:"histories,omitempty"`
+    Attributes json.RawMessage          `json:"attributes,omitempty"`
+    Timers []timerSnapshot              `json:"timers,omitempty"`
+}
+
+// timerSnapshot defines a running timer in a snapshot. Name is empty for the
+// timeout of state.
+type timerSnapshot struct{
+    StateID string      `json:"state"`
+    Name string         `json:"name,omitempty"`
+    Remaining duration  `json:"remaining"`
+}
+
+// SetAttributeCodec sets the codec of context attributes in snapshots. The
+// default one is a JSONAttributeCodec, which only supports basic types unless
+// other types are registered.
+func (sm *StateMachine) SetAttributeCodec(codec AttributeCodec) *StateMachine{
+    sm.attributeCodec = codec
+    return sm
+}
+
+// Snapshot returns the state of state machine in json, include its status, the
+// active states, current and previous states, histories, context attributes and
+// the remaining time of running timers. The events queued, deferred or scheduled
+// are not included. It waits for the event processing, so it must not be called
+// in actions and listeners.
+func (sm *StateMachine) Snapshot() ([]byte, error){
+    sm.locker.Lock()
+    defer sm.locker.Unlock()
+
+    return sm.snapshot()
+}
+
+// snapshot encodes the state of state machine. Should lock before call this
+// method.
+func (sm *StateMachine) snapshot() ([]byte, error){
+    attributes, err := sm.attributeCodec.Encode(sm.context.attributes)
+    if err != nil {
+        return nil, err
+    }
+
+    now := sm.clock.Now()
+    s := snapshot{
+        Version: SNAPSHOT_VERSION,
+        Time: now,
+        Status: sm.runStatus,
+        ActiveStateIDs: sm.activeStateIDs(),
+        HistoryValues: sm.historyValues,
+        Attributes: attributes,
+    }
+    if sm.currentState != nil {
+        s.CurrentStateID = sm.currentState.ID()
+    }
+    if sm.previousState != nil {
+        s.PreviousStateID = sm.previousState.ID()
+    }
+
+    for _, id := range s.ActiveStateIDs {
+        for _, r := range sm.runningTimers[id] {
+            remaining := r.due.Sub(now)
+            if remaining < 0 {
+                remaining = 0
+            }
+            s.Timers = append(s.Timers, timerSnapshot{id, r.timer.Name, duration(remaining)})
+        }
+    }
+
+    data, err := json.Marshal(&s)
+    if err != nil {
+        return nil, &SnapshotError{Message: "Can't encode snapshot.", Cause: err}
+    }
+    return data, nil
+}
+
+// Restore resumes state machine in the state of a snapshot, which is taken by
+// Snapshot of a state machine with the same configuration. No action is
+// executed and listeners are not notified, the timers are started again with
+// their remaining time. The events queued or deferred are discarded, and the
+// scheduled events are cancelled. Start always goes to the initial state, not
+// the restored state. It waits for the event processing like Snapshot.
+func (sm *StateMachine) Restore(data []byte) (err error){
+    s, err := decodeSnapshot(data)
+    if err != nil {
+        return err
+    }
+
+    sm.process(func(){
+        err = sm.restore(s, 0)
+    })
+    return err
+}
+
+// decodeSnapshot decodes a snapshot and checks its version.
+func decodeSnapshot(data []byte) (*snapshot, error){
+    var s snapshot
+    if err := json.Unmarshal(data, &s); err != nil {
+        return nil, &SnapshotError{Message: "Can't decode snapshot.", Cause: err}
+    }
+    if s.Version != SNAPSHOT_VERSION {
+        return nil, &SnapshotError{Message: fmt.Sprintf("Unsupported snapshot version [%d].", s.Version)}
+    }
+    return &s, nil
+}
+
+// restore restores a decoded snapshot, the remaining time of timers is reduced
+// by elapsed. It checks the snapshot before changing anything, so state machine
+// is not changed if there is an error. Should lock before call this method.
+func (sm *StateMachine) restore(s *snapshot, elapsed time.Duration) error{
+    if err := sm.checkSnapshot(s); err != nil {
+        return err
+    }
+    attributes := make(map[Any]Any)
+    if len(s.Attributes) > 0 {
+        var err error
+        if attributes, err = sm.attributeCodec.Decode(s.Attributes); err != nil {
+            return err
+        }
+    }
+
+    // leave the current states silently
+    for id := range sm.runningTimers {
+        sm.cancelTimers(id)
+    }
+    sm.clearInternalEvents()
+    sm.cancelAllScheduled()
+    sm.setDeferredEvents(nil)
+    sm.evicted = false
+
+    sm.stateLocker.Lock()
+    sm.active = make(map[string]bool)
+    for _, id := range s.ActiveStateIDs {
+        sm.active[id] = true
+    }
+    sm.currentState = sm.states[s.CurrentStateID]
+    sm.previousState = sm.states[s.PreviousStateID]
+    sm.nextState = nil
+    sm.event = nil
+    sm.runStatus = s.Status
+    sm.stateLocker.Unlock()
+
+    sm.historyValues = make(map[string][]string)
+    for id, v := range s.HistoryValues {
+        sm.historyValues[id] = v
+    }
+    for k := range sm.context.attributes {
+        delete(sm.context.attributes, k)
+    }
+    for k, v := range attributes {
+        sm.context.attributes[k] = v
+    }
+
+    if s.Status == STATUS_RUNNING {
+        sm.renewDone()
+    }else{
+        sm.closeDone()
+    }
+
+    // the timers are new, as if the states are entered again
+    for _, id := range s.ActiveStateIDs {
+        sm.generations[id]++
+    }
+    for _, t := range s.Timers {
+        timer, _ := sm.findTimer(t.StateID, t.Name)
+        r := &runningTimer{stateID: t.StateID, timer: timer, generation: sm.generations[t.StateID]}
+        remaining := time.Duration(t.Remaining) - elapsed
+        if remaining < 0 {
+            remaining = 0
+        }
+        sm.startTimer(r, remaining)
+        sm.runningTimers[t.StateID] = append(sm.runningTimers[t.StateID], r)
+    }
+    return nil
+}
+
+// checkSnapshot checks that the states, histories and timers in snapshot are
+// configured.
+func (sm *StateMachine) checkSnapshot(s *snapshot) error{
+    if s.Status != STATUS_STOPPED && s.Status != STATUS_RUNNING && s.Status != STATUS_FINISHED {
+        return &SnapshotError{Message: fmt.Sprintf("Invalid status [%d] in snapshot.", s.Status)}
+    }
+
+    ids := append([]string{s.CurrentStateID, s.PreviousStateID}, s.ActiveStateIDs...)
+    for id, v := range s.HistoryValues {
+        if _, ok := sm.histories[id]; !ok {
+            return &SnapshotError{Message: "Has no history [" + id + "] in snapshot."}
+        }
+        ids = append(ids, v...)
+    }
+    for _, id := range ids {
+        if id != "" && sm.states[id] == nil {
+            return &SnapshotError{Message: "Has no state [" + id + "] in snapshot."}
+        }
+    }
+
+    active := make(map[string]bool)
+    for _, id := range s.ActiveStateIDs {
+        active[id] = true
+    }
+    for _, t := range s.Timers {
+        if !active[t.StateID] {
+            return &SnapshotError{Message: "Timer of state [" + t.StateID + "] is not of an active state."}
+        }
+        if _, ok := sm.findTimer(t.StateID, t.Name); !ok {
+            return &SnapshotError{Message: "Has no timer [" + t.Name + "] of state [" + t.StateID + "]."}
+        }
+    }
+    return nil
+}
+
+// findTimer returns the timer of state by name, or the timeout of state if the
+// name is empty.
+func (sm *StateMachine) findTimer(stateID, name string) (StateTimer, bool){
+    if name == "" {
+        d := sm.timeouts[stateID]
+        return StateTimer{Delay: d, Event: sm.timeoutEvent}, d > 0
+    }
+    for _, t := range sm.stateTimers[stateID] {
+        if t.Name == name {
+            return t, true
+        }
+    }
+    return StateTimer{}, false
+}
+
+// suspend takes a snapshot and passes it to save, with the remaining time of
+// the first timer due if there are timers running. If save succeeds, the timers
+// are cancelled, and state machine is marked evicted. Its status and done
+// channel are not changed, because it goes on in the state machine restored
+// from the snapshot later, but it refuses events, Start and Stop by panicking
+// with ErrEvicted. The events scheduled or deferred are not in snapshot, so it
+// returns errNotIdle without saving if there are any.
+func (sm *StateMachine) suspend(save func(data []byte, next time.Duration, hasNext bool) error) error{
+    sm.locker.Lock()
+    defer sm.locker.Unlock()
+
+    if len(sm.deferredEvents) > 0 || sm.hasScheduled() {
+        return errNotIdle
+    }
+
+    data, err := sm.snapshot()
+    if err != nil {
+        return err
+    }
+
+    var next time.Duration
+    hasNext := false
+    now := sm.clock.Now()
+    for _, l := range sm.runningTimers {
+        for _, r := range l {
+            if d := r.due.Sub(now); !hasNext || d < next {
+                next, hasNext = d, true
+            }
+        }
+    }
+    if err := save(data, next, hasNext); err != nil {
+        return err
+    }
+
+    for id := range sm.runningTimers {
+        sm.cancelTimers(id)
+    }
+    sm.evicted = true
+    return nil
+}
+
+// checkEvicted panics with ErrEvicted if state machine is evicted. Should lock
+// before call this method.
+func (sm *StateMachine) checkEvicted(){
+    if sm.evicted {
+        panic(ErrEvicted)
+    }
+}
+
+// resume restores a snapshot taken by suspend, the time elapsed since taking the
+// snapshot is taken off the remaining time of timers, so the timers due while
+// suspended fire at once. The snapshots saved before having the time are
+// restored without elapsed time.
+func (sm *StateMachine) resume(data []byte) (err error){
+    s, err := decodeSnapshot(data)
+    if err != nil {
+        return err
+    }
+
+    sm.process(func(){
+        var elapsed time.Duration
+        if !s.Time.IsZero() {
+            elapsed = sm.clock.Now().Sub(s.Time)
+        }
+        if elapsed < 0 {
+            elapsed = 0
+        }
+        err = sm.restore(s, elapsed)
+    })
+    return err
+}
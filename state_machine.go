@@ -1,11 +1,14 @@
 // Package hackberry provides one state machine and its related concepts:
-//	State: state of state machine;
+//	State: state of state machine, a state can have sub states, which are all active
+//		at the same time if the state is a parallel state;
 //	Event: event that drives state machine changed from one state to another;
 //	Transition: one transition defines a changement of state machine, include source state, 
 //				target state, event and a optional condition that must be satisfied;
 //	Action: actions that will be executed when entering a state or exiting a state;
 //	ConditionEvaluator: evaluate the conditions in transition;
 //	ActionDispatcher: call action executor when entering or exiting state.
+//	Definition: the frozen configuration of state machine, which is built once and shared
+//		by many state machines.
 // 
 // StateMachine can be set completely using its methods manully, and can also be set with config file.
 //
@@ -15,10 +18,17 @@
 package hackberry
 
 import (
+    "fmt"
     "time"
     "sync"
 )
 
+// the default clock and attribute codec, they are shared by state machines.
+var (
+    defaultClock = NewRealClock()
+    defaultAttributeCodec = NewJSONAttributeCodec()
+)
+
 // Any is an empty interface, can represent anything.
 type Any interface{}
 
@@ -37,6 +47,16 @@ type Event interface{
     Name() string
 }
 
+// DataEvent is an event that carries data. When state machine is processing
+// it, conditions and actions can get the data from Context. Implementing it
+// is optional, DefaultEvent implements it.
+type DataEvent interface{
+    Event
+    
+    // Data return the data of event.
+    Data() map[string]Any
+}
+
 // ConditionEvaluator judges the condition in transition is satisfied or not. 
 // User can implement this, or using NewDefaultConditionEvaluator to get the
 //  default evaluator.
@@ -72,6 +92,19 @@ type Transition struct{
     TargetID string
     
     // EventName is the name of the event that drives state machine to transform.
+    // It can be event descriptors separated by spaces like "e1 e2 error.*", and
+    // the transition matches an event if any descriptor matches. A descriptor
+    // matches the events named it or prefixed with it and a dot, "error" and
+    // "error.*" both match "error.network", and "*" matches all events. "*" is
+    // only allowed alone or after a dot, a descriptor like "error*" is invalid.
+    //
+    // Exact and wildcard descriptors have the same precedence. Transitions of a
+    // state are tried in the order of adding and the first enabled one is taken,
+    // so a catch-all transition like "*" should be added after the others. The
+    // transitions of inner states are always tried before those of outer states.
+    //
+    // A transition without event name is an eventless transition, it is taken
+    // automatically when its condition is satisfied after any transition.
     EventName string
     
     // Condition restricts the transformation. Only when the condition is
@@ -79,7 +112,41 @@ type Transition struct{
     Condition string
 }
 
-// Action defines a action when entering or exiting a state.
+// transitionDef is a transition added to state machine with its actions.
+type transitionDef struct{
+    Transition
+    
+    // actions are executed after exit actions of source states and before
+    // entry actions of target states.
+    actions []Action
+    
+    // transitionType is TRANSITION_EXTERNAL or TRANSITION_INTERNAL.
+    transitionType int
+}
+
+// DEFAULT_MAX_EVENTLESS_STEPS is the default max times of taking eventless
+// transitions after one event.
+const DEFAULT_MAX_EVENTLESS_STEPS = 100
+
+// The type of transition
+const (
+    // The transition exits its source state, even if the target is the source
+    // state or its descendant.
+    TRANSITION_EXTERNAL = iota
+    
+    // The transition doesn't exit its source state if the source state is a 
+    // compound state and the target is its descendant. 
+    TRANSITION_INTERNAL
+)
+
+// isTargetless returns if the transition only executes its actions without
+// exiting and entering states. A transition without target is always targetless.
+func (t *transitionDef) isTargetless() bool{
+    return t.TargetID == "" || t.transitionType == TRANSITION_INTERNAL && t.TargetID == t.SourceID
+}
+
+// Action defines a action when entering or exiting a state, or executed by
+// a transition.
 type Action struct{
 	// Name indicates the name of the method should be called.
 	// The name format should be fit ActionDispatcher. When using the default 
@@ -101,6 +168,10 @@ const (
     // The state machine is running. It is after calling Start() and before
     // calling Stop().
     STATUS_RUNNING
+    
+    // The state machine is not running, because it entered a top level final
+    // state and stopped itself.
+    STATUS_FINISHED
 )
 
 // StateMachine defines a state machine. There are some step to use StateMachine
@@ -108,21 +179,26 @@ const (
 //	1. implement State interface and Event interface if needed, or use the default;
 //	2. create ActionDispatcher and ConditionEvaluator if needed;
 //	3. using NewStateMachine to create a state machine instance;
-//	4. add all states to the state machine instance if not using DefaultState and Configurer;
+//	4. add all states and sub states to the state machine instance if not using DefaultState and Configurer;
 //	5. configure state machine by Configurer or by methods;
 //	6. start the state machine;
 //	7. send event to the state machine;
-//	8. stop the state machine if needed.
+//	8. stop the state machine if needed, or wait for it entering a top level final state by Done().
 type StateMachine struct{
+    // the configuration of state machine, it may be shared by other state
+    // machines after being frozen by Definition.
+    *definition
+    
     // state machine status, receive event only when being running status
     runStatus int
     
-    // state machine's initial state's id
-    initialStateID string
-    
-    // state machine's current state
+    // state machine's current state. If there are several active atomic states
+    // in parallel states, it is the first one in document order.
     currentState State
     
+    // the ids of all active states, include current states and their ancestors.
+    active map[string]bool
+    
     // the previous state of state machine
     previousState State
     
@@ -132,60 +208,110 @@ type StateMachine struct{
     // is the target state
     nextState State
     
-    // the event triggered state machine just now
+    // the event that state machine is processing, or processed just now
     event Event
-
+    
     // state machine's context
     context Context
     
-    // all states of this state machine
-    states map[string]State
+    // the remembered state ids of each history pseudo-state.
+    historyValues map[string][]string
+    
+    // the events raised by state machine itself or by actions, such as done
+    // events of final states. They are processed after the current transition.
+    internalEvents []Event
+    
+    // the events sent to state machine and not processed yet.
+    externalEvents []queuedEvent
     
-    // all transitions of this state machine. Each state has a transition list.
-    transitions map[string][]Transition
+    // if a goroutine is processing events. Events sent meanwhile are queued
+    // and processed by that goroutine.
+    processing bool
     
-    // all entry actions of this state machine. Each state has a entry action list.
-    entryActions map[string][]Action
+    // the events deferred by active states, in the order of sending. They are
+    // guarded by stateLocker.
+    deferredEvents []Event
     
-    // all exit actions of this state machine. Each state has a exit action list.
-    exitActions map[string][]Action
+    // the channel closed when state machine stops, it is guarded by
+    // stateLocker.
+    done chan struct{}
     
-    // all timeouts of state that are greater than zero.
-    timeouts map[string]int
+    // the timeout and named timers running, for each active state having timers.
+    runningTimers map[string][]*runningTimer
     
-    // condition evaluator
-    conditionEvaluator ConditionEvaluator
+    // the generation of each state, it changes when entering and exiting the
+    // state. A fired timer is discarded if its generation is not current.
+    generations map[string]uint64
     
-    // action dispatcher
-    actionDispatcher ActionDispatcher
+    // the events scheduled by SendEventAfter and not sent yet, by their ids.
+    // They are guarded by queueLocker.
+    scheduled map[string]*scheduledEvent
     
-    // timeout event. If some states have timeout greater than zero, this 
-    // attribute should be set.
-    timeoutEvent Event
+    // the sequence of scheduled events' ids.
+    scheduledSeq int
     
-    // thd id of default state when timeout happened.
-    defaultTimeoutStateID string
+    // the clock providing timers.
+    clock Clock
     
-    // the channel to cancel timeout
-    timeoutChannel chan int
+    // the codec of context attributes in snapshots.
+    attributeCodec AttributeCodec
+    
+    // the store that snapshots are saved to after transitions, the id of state
+    // machine in it, and the version saved last.
+    store Store
+    storeID string
+    storeVersion int64
+    
+    // the journal that entries are appended to, the sequence of the last entry,
+    // and the entry of the event processing.
+    journal Journal
+    journalSeq int64
+    journalEntry *JournalEntry
+    
+    // if state machine is evicted by passivation, it keeps the state when
+    // evicting, but refuses events.
+    evicted bool
+    
+    // if state machine is replaying a journal, actions and listeners are not
+    // called then.
+    replaying bool
+    
+    // the result recording what happened when processing an event, it is nil
+    // if no result is required.
+    result *EventResult
+    
+    // the listeners observing state machine.
+    listeners []Listener
     
     // transform locker
     locker sync.Mutex
+    
+    // locker of the event queues and processing flag
+    queueLocker sync.Mutex
+    
+    // locker of the status, active states, current, previous and next states and
+    // the event, so that they can be read by other goroutines while processing.
+    stateLocker sync.RWMutex
 }
 
 // NewStateMachine create a state machine instance.
 func NewStateMachine(ce ConditionEvaluator, ad ActionDispatcher) *StateMachine{
-    sm := StateMachine{}
+    return newStateMachine(newDefinition(ce, ad))
+}
+
+// newStateMachine creates a state machine instance of the definition.
+func newStateMachine(def *definition) *StateMachine{
+    sm := StateMachine{definition: def}
     
     sm.context = Context{&sm, make(map[Any]Any)}
-    sm.states = make(map[string]State)
-    sm.transitions = make(map[string][]Transition)
-    sm.entryActions = make(map[string][]Action)
-    sm.exitActions = make(map[string][]Action)
-    sm.timeouts = make(map[string]int)
-
-    sm.conditionEvaluator = ce
-    sm.actionDispatcher = ad
+    sm.historyValues = make(map[string][]string)
+    sm.done = make(chan struct{})
+    sm.active = make(map[string]bool)
+    sm.generations = make(map[string]uint64)
+    sm.runningTimers = make(map[string][]*runningTimer)
+    sm.scheduled = make(map[string]*scheduledEvent)
+    sm.clock = defaultClock
+    sm.attributeCodec = defaultAttributeCodec
     
     return &sm;
 }
@@ -197,23 +323,112 @@ func (sm *StateMachine) GetContext() *Context{
 
 // AddState adds one state to state machine.
 func (sm *StateMachine) AddState(s State) *StateMachine{
+    sm.checkMutable()
+    if _, ok := sm.order[s.ID()]; !ok {
+        sm.order[s.ID()] = len(sm.order)
+    }
     sm.states[s.ID()] = s
+    sm.docOrder = nil
     return sm
 }
 
 // AddStates adds some states to state machine.
 func (sm *StateMachine) AddStates(ss []State) *StateMachine{
     for i := 0; i < len(ss); i++{
-        sm.states[ss[i].ID()] = ss[i]
+        sm.AddState(ss[i])
     }
     return sm
 }
 
-// AddTransition adds one transition to state machine. If the transition has
-// condition, the state machine must has condition evaluator first.
-func (sm *StateMachine) AddTransition(t Transition) *StateMachine{
+// AddSubState adds one state to state machine as a sub state of the parent
+// state, the parent state should be added first. A state that has sub states
+// is a compound state. Entering a compound state enters its initial sub state
+// too, and the transitions of a compound state apply to all its sub states.
+func (sm *StateMachine) AddSubState(parentID string, s State) *StateMachine{
+    sm.checkMutable()
+    if sm.states[parentID] == nil {
+        panic(&ConfigError{Message: "Has no parent state [" + parentID + "]."})
+    }
+
+    id := s.ID()
+    if id == parentID || sm.isDescendant(parentID, id) {
+        panic(&ConfigError{Message: "State [" + id + "] can't be a sub state of itself or its descendant."})
+    }
+    if sm.finals[parentID] {
+        panic(&ConfigError{Message: "Final state [" + parentID + "] can't have sub states."})
+    }
+    if p, ok := sm.parents[id]; ok && p != parentID {
+        panic(&ConfigError{Message: "State [" + id + "] is already a sub state of [" + p + "]."})
+    }
+
+    if _, ok := sm.parents[id]; !ok {
+        sm.parents[id] = parentID
+        sm.children[parentID] = append(sm.children[parentID], id)
+    }
+    return sm.AddState(s)
+}
+
+// AddSubStates adds some states to state machine as sub states of the parent state.
+func (sm *StateMachine) AddSubStates(parentID string, ss []State) *StateMachine{
+    for i := 0; i < len(ss); i++{
+        sm.AddSubState(parentID, ss[i])
+    }
+    return sm
+}
+
+// SetInitialSubStateID sets the initial sub state's id of a compound state.
+// The sub state should be added first. If it is not set, the first added sub
+// state is the initial sub state.
+func (sm *StateMachine) SetInitialSubStateID(parentID, stateID string) *StateMachine{
+    sm.checkMutable()
+    if p, ok := sm.parents[stateID]; !ok || p != parentID {
+        panic(&ConfigError{Message: "State [" + stateID + "] is not a sub state of [" + parentID + "]."})
+    }
+
+    sm.initialChildren[parentID] = stateID
+    return sm
+}
+
+// SetParallel sets a state to be a parallel state. When entering a parallel
+// state, all its sub states are entered, each of them is a region. One event
+// can trigger transitions in every active region.
+func (sm *StateMachine) SetParallel(stateID string) *StateMachine{
+    sm.checkMutable()
+    if sm.states[stateID] == nil {
+        panic(&ConfigError{Message: "Has no state [" + stateID + "]."})
+    }
+
+    sm.parallels[stateID] = true
+    return sm
+}
+
+// AddTransition adds one transition to state machine, the actions are executed
+// after exit actions of source states and before entry actions of target states.
+// If the transition has condition, the state machine must has condition
+// evaluator first. If it has actions, the state machine must has action
+// dispatcher first.
+func (sm *StateMachine) AddTransition(t Transition, actions ...Action) *StateMachine{
+    return sm.addTransitionDef(transitionDef{t, actions, TRANSITION_EXTERNAL})
+}
+
+// AddInternalTransition adds one internal transition to state machine. It is
+// like AddTransition, but the transition doesn't exit its source state if the
+// source state is a compound state and the target is its descendant. If the
+// target is empty or the source state, it only executes its actions, the states,
+// their timeouts and histories are not changed.
+func (sm *StateMachine) AddInternalTransition(t Transition, actions ...Action) *StateMachine{
+    return sm.addTransitionDef(transitionDef{t, actions, TRANSITION_INTERNAL})
+}
+
+// addTransitionDef checks and adds one transition to state machine.
+func (sm *StateMachine) addTransitionDef(t transitionDef) *StateMachine{
+    sm.checkMutable()
+    checkDescriptors(t.EventName)
     if t.Condition != "" && sm.conditionEvaluator == nil {
-        panic(&ConfigError{"Has no condition evaluator."})
+        panic(&ConfigError{Message: "Has no condition evaluator."})
+    }
+    if len(t.actions) > 0 && sm.actionDispatcher == nil {
+        panic(&ConfigError{Message: "Has no action dispatcher."})
     }
 
     l := append(sm.transitions[t.SourceID], t)
@@ -225,8 +440,9 @@ func (sm *StateMachine) AddTransition(t Transition) *StateMachine{
 // AddOnEntry adds one entry action to state machine. The state machine must
 // has action dispatcher first.
 func (sm *StateMachine) AddOnEntry(stateID string, a Action) *StateMachine{
+    sm.checkMutable()
     if sm.actionDispatcher == nil {
-        panic(&ConfigError{"Has no action dispatcher."})
+        panic(&ConfigError{Message: "Has no action dispatcher."})
     }
 
     l := append(sm.entryActions[stateID], a)
@@ -238,8 +454,9 @@ func (sm *StateMachine) AddOnEntry(stateID string, a Action) *StateMachine{
 // AddOnExit adds one exit action to state machine. The state machine must
 // has action dispatcher first.
 func (sm *StateMachine) AddOnExit(stateID string, a Action) *StateMachine{
+    sm.checkMutable()
     if sm.actionDispatcher == nil {
-        panic(&ConfigError{"Has no action dispatcher."})
+        panic(&ConfigError{Message: "Has no action dispatcher."})
     }
 
     l := append(sm.exitActions[stateID], a)
@@ -251,111 +468,499 @@ func (sm *StateMachine) AddOnExit(stateID string, a Action) *StateMachine{
 // AddTimeout adds a state's timeout to state machine. The state machine must
 // has the timeout event set first. Seconds should be greater than zero.
 func (sm *StateMachine) AddTimeout(stateID string, seconds int) *StateMachine{
+    return sm.AddTimeoutDuration(stateID, time.Duration(seconds) * time.Second)
+}
+
+// AddTimeoutDuration adds a state's timeout to state machine like AddTimeout,
+// but the timeout is a duration, such as 200 * time.Millisecond. The duration
+// should be greater than zero.
+func (sm *StateMachine) AddTimeoutDuration(stateID string, d time.Duration) *StateMachine{
+    sm.checkMutable()
     if sm.timeoutEvent == nil {
-        panic(&ConfigError{"Has no timeout event."})
+        panic(&ConfigError{Message: "Has no timeout event."})
     }
     
-    if seconds > 0 {
-        sm.timeouts[stateID] = seconds
+    if d > 0 {
+        sm.timeouts[stateID] = d
     }
     
     return sm;
 }
     
-// SendEvent sends the event to state machine, trigger state transform.
+// SendEvent sends the event to state machine, trigger state transform. Events
+// are processed one by one in the order of sending. If another goroutine is
+// processing events, the event is queued and SendEvent returns at once, the
+// event is processed by that goroutine later. So actions can call SendEvent
+// too, the event is processed after the current event and its internal events.
+//
+// SendEvent panics if processing the event panics. If the event is only queued,
+// the panic is reported to listeners by OnEventFailed instead, and doesn't go
+// on in the goroutine processing it.
 func (sm *StateMachine) SendEvent(event Event){
+    var failure Any
+    if sm.send(event, func(r Any){ failure = r }) {
+        sm.process(nil)
+        if failure != nil {
+            panic(failure)
+        }
+    }
+}
+
+// post sends the event like SendEvent, but never panics, the panic of
+// processing the event is reported to listeners. It is used by the functions
+// called by clock, which have no one to recover the panic.
+func (sm *StateMachine) post(event Event){
+    if sm.send(event, nil) {
+        sm.process(nil)
+    }
+}
+
+// queuedEvent is an event sent to state machine and not processed yet.
+type queuedEvent struct{
+    event Event
+
+    // it is called with the panic of processing the event if the sender waits
+    // for the event, otherwise the panic is reported to listeners.
+    report func(failure Any)
+}
+
+// send queues the event, and returns if the caller should process the queued
+// events, that is no goroutine is processing them. If a goroutine is processing
+// them already, the sender doesn't wait for the event, so report is dropped.
+func (sm *StateMachine) send(event Event, report func(failure Any)) bool{
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+    
+    if sm.processing {
+        report = nil
+    }
+    sm.externalEvents = append(sm.externalEvents, queuedEvent{event, report})
+    return !sm.processing
+}
+
+// Raise raises an event to the internal event queue. It should be called while
+// processing an event, such as in actions. The event is processed after the
+// current transition is finished, before the events sent by SendEvent.
+func (sm *StateMachine) Raise(event Event){
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+    
+    sm.internalEvents = append(sm.internalEvents, event)
+}
+
+// process locks state machine, runs f and then processes the queued events
+// until the queue is empty. Events sent meanwhile are only queued. The panic
+// of each queued event is reported to its sender or listeners, and the following
+// events are still processed. If f panics, the panic goes on after the queue is
+// empty.
+func (sm *StateMachine) process(f func()){
     sm.locker.Lock()
     defer sm.locker.Unlock()
     
-    if !sm.IsRunning() { return }
+    sm.queueLocker.Lock()
+    sm.processing = true
+    sm.queueLocker.Unlock()
     
-    if target := sm.getTarget(event); target != nil {
-        sm.transitState(event, target);
+    var failure Any
+    if f != nil {
+        failure = sm.recoverEvent(f)
+    }
+    for {
+        q, ok := sm.nextExternalEvent()
+        if !ok { break }
+        if r := sm.recoverEvent(func(){ sm.processEvent(q.event) }); r != nil {
+            sm.eventFailed(q, r)
+        }
+    }
+    if failure != nil {
+        panic(failure)
     }
 }
 
-// getTarget returns target state by event. Should ock before call this method.
-func (sm *StateMachine) getTarget(event Event) State{
-    trans := sm.transitions[sm.currentState.ID()]
-    for _, t := range trans{
-        if event.Name() != t.EventName { continue }
+// recoverEvent calls f to process an event and returns its panic. If f panics,
+// the journal entry and the internal events raised by the failed event are
+// discarded. Should lock before call this method.
+func (sm *StateMachine) recoverEvent(f func()) (failure Any){
+    defer func(){
+        if failure = recover(); failure != nil {
+            sm.journalEntry = nil
+            sm.clearInternalEvents()
+        }
+    }()
+    
+    f()
+    return nil
+}
+
+// eventFailed reports the panic of processing a queued event to its sender, or
+// to listeners if the sender doesn't wait for it. Should lock before call this
+// method.
+func (sm *StateMachine) eventFailed(q queuedEvent, failure Any){
+    if q.report != nil {
+        q.report(failure)
+        return
+    }
+    sm.notifyFailed(q.event, failure)
+}
+
+// nextExternalEvent removes the first event from the external queue. If the
+// queue is empty, it clears the processing flag at the same time, so that the
+// next sending processes events itself.
+func (sm *StateMachine) nextExternalEvent() (queuedEvent, bool){
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+    
+    if len(sm.externalEvents) == 0 {
+        sm.processing = false
+        return queuedEvent{}, false
+    }
+    q := sm.externalEvents[0]
+    sm.externalEvents = sm.externalEvents[1:]
+    return q, true
+}
+
+// nextInternalEvent removes the first event from the internal queue.
+func (sm *StateMachine) nextInternalEvent() (Event, bool){
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+    
+    if len(sm.internalEvents) == 0 {
+        return nil, false
+    }
+    event := sm.internalEvents[0]
+    sm.internalEvents = sm.internalEvents[1:]
+    return event, true
+}
+
+// clearInternalEvents discards all events in the internal queue.
+func (sm *StateMachine) clearInternalEvents(){
+    sm.queueLocker.Lock()
+    defer sm.queueLocker.Unlock()
+    
+    sm.internalEvents = nil
+}
+
+// processEvent processes an external event and all internal events raised
+// after it, then the deferred events that are not deferred any more. Should
+// lock before call this method.
+func (sm *StateMachine) processEvent(event Event){
+    if e, ok := event.(*timerEvent); ok {
+        if event = sm.timerFired(e); event == nil { return }
+    }
+    sm.offerEvent(event)
+    sm.processDeferredEvents()
+}
+
+// offerEvent processes an external event and all internal events raised after
+// it. If the event enables no transition and is deferred by an active state,
+// it is kept to be offered again. Should lock before call this method.
+func (sm *StateMachine) offerEvent(event Event){
+    if event == nil { return }
+    sm.checkEvicted()
+    if !sm.IsRunning() {
+        sm.notifyIgnored(event, false)
+        return
+    }
+    
+    // conditions may use the data of event
+    sm.setEvent(event)
+    sm.beginJournal(JOURNAL_EVENT, event)
+    if trans := sm.selectTransitions(event); len(trans) > 0 {
+        sm.transitState(event, trans);
+    }else if sm.isDeferred(event) {
+        sm.setDeferredEvents(append(sm.deferredEvents, event))
+    }else{
+        sm.notifyIgnored(event, true)
+    }
+    
+    // only the transitions of the event itself are recorded
+    sm.result = nil
+    sm.processInternalEvents()
+    sm.endJournal()
+}
+
+// processInternalEvents takes eventless transitions until there is no one
+// enabled, then processes one event raised by state machine itself, and so on
+// until the state machine is stable or finished. Should lock before call this
+// method.
+func (sm *StateMachine) processInternalEvents(){
+    steps := 0
+    for sm.IsRunning() {
+        if sm.isFinished() {
+            sm.stop(STATUS_FINISHED)
+            return
+        }
         
-        // has condition, but not satisfy
-        if "" != t.Condition && !sm.conditionEvaluator.IsSatisfied(t.Condition, &sm.context) {
+        if trans := sm.selectTransitions(nil); len(trans) > 0 {
+            if steps++; steps > sm.maxEventlessSteps {
+                msg := fmt.Sprintf("Eventless transitions are taken more than %d times, maybe there is a cycle.",
+                    sm.maxEventlessSteps)
+                panic(&ConfigError{Message: msg})
+            }
+            sm.transitState(sm.event, trans);
             continue
-        }    
+        }
         
-        return sm.states[t.TargetID]
+        event, ok := sm.nextInternalEvent()
+        if !ok { return }
+        
+        sm.setEvent(event)
+        if trans := sm.selectTransitions(event); len(trans) > 0 {
+            sm.transitState(event, trans);
+        }else{
+            sm.notifyIgnored(event, true)
+        }
+    }
+}
+
+// selectTransitions returns the transitions triggered by event, or the eventless
+// transitions if event is nil. For each current state in document order, the
+// transitions of itself are tried first, then the transitions of its ancestors
+// from the inner to the outer, the first one enabled is selected. If two
+// selected transitions exit same states, the one of inner source state is kept.
+// Should lock before call this method.
+func (sm *StateMachine) selectTransitions(event Event) []*transitionDef{
+    var trans []*transitionDef
+    for _, atomicID := range sm.atomicStateIDs() {
+        if t := sm.getTransition(atomicID, event); t != nil {
+            trans = sm.addTransition(trans, t)
+        }
     }
 
     // default timeout transition
-    if sm.timeoutEvent != nil && sm.timeoutEvent.Name() == event.Name() {
-        return sm.states[sm.defaultTimeoutStateID]
+    if len(trans) == 0 && event != nil && sm.timeoutEvent != nil && sm.timeoutEvent.Name() == event.Name() &&
+        sm.states[sm.defaultTimeoutStateID] != nil {
+        trans = append(trans, &transitionDef{Transition: Transition{SourceID: sm.currentState.ID(), TargetID: sm.defaultTimeoutStateID}})
+    }
+    return trans
+}
+
+// getTransition returns the transition of the state or its ancestors that
+// is triggered by event, or the eventless one if event is nil.
+func (sm *StateMachine) getTransition(stateID string, event Event) *transitionDef{
+    for id, ok := stateID, true; ok; id, ok = sm.parents[id] {
+        trans := sm.transitions[id]
+        for i, t := range trans{
+            if event == nil && t.EventName != "" { continue }
+            if event != nil && !matchEvent(t.EventName, event.Name()) { continue }
+            
+            // has condition, but not satisfy
+            if "" != t.Condition && !sm.isSatisfied(&trans[i]) {
+                continue
+            }    
+            
+            if t.TargetID != "" && !sm.isTarget(t.TargetID) { return nil }
+            return &trans[i]
+        }
     }
     return nil
 }
 
-// transitStatet transforms state machine to new state. Should lock before
-// call this method
-func (sm *StateMachine) transitState(event Event, target State) {
-    sm.cancelTimeout();
-    sm.event = event;
-    sm.nextState = target;
-    
-    if sm.currentState != nil {
-        // exit actions
-        actions := sm.exitActions[sm.currentState.ID()]
-        for _, a := range actions {
-            sm.actionDispatcher.Dispatch(a, &sm.context)
+// addTransition adds a transition to the selected transitions if it is not
+// conflicting with others, or its source state is a descendant of the source
+// states of conflicting transitions.
+func (sm *StateMachine) addTransition(trans []*transitionDef, t *transitionDef) []*transitionDef{
+    var kept []*transitionDef
+    for _, o := range trans {
+        if o == t { return trans }
+        if !sm.isConflicting(o, t) {
+            kept = append(kept, o)
+        }else if !sm.isDescendant(t.SourceID, o.SourceID) {
+            return trans
         }
     }
+    return append(kept, t)
+}
+
+// transitState transforms state machine by the transitions. The active states
+// under the domains of transitions are exited in reverse document order, then
+// the actions of transitions are executed, and then the states from the domains
+// to the targets are entered in document order. Should lock before call this
+// method.
+func (sm *StateMachine) transitState(event Event, trans []*transitionDef) {
+    exits := sm.exitSet(trans)
+    entries := sm.entrySet(trans)
+    
+    sm.setEvent(event)
+    next := sm.nextCurrentState(exits, entries)
+    sm.stateLocker.Lock()
+    sm.nextState = next
+    sm.stateLocker.Unlock()
+    
+    sm.recordTransitions(trans)
+    sm.journalTransitions(trans)
+    for _, t := range trans {
+        sm.notify(func(l Listener){
+            l.BeforeTransition(&sm.context, event, t.Transition)
+        })
+    }
+    sm.exitStates(exits)
+    
+    // transition actions
+    for _, t := range trans {
+        sm.dispatchActions(t.actions)
+    }
     
-    // transform
-    sm.previousState = sm.currentState;
-    sm.currentState = sm.nextState;
+    // transform. targetless transitions don't change states.
+    sm.stateLocker.Lock()
+    if len(exits) > 0 || len(entries) > 0 {
+        sm.previousState = sm.currentState;
+        sm.currentState = sm.nextState;
+    }
     sm.nextState = nil;
+    sm.stateLocker.Unlock()
     
-    if sm.currentState != nil {
-        // entry actions
-        actions := sm.entryActions[sm.currentState.ID()]
-        for _, a := range actions {
-            sm.actionDispatcher.Dispatch(a, &sm.context)
-        }
-        
-        // begin to count time for timeout after all entry actions
-        sm.createTimeout(sm.currentState);
+    sm.enterStates(entries)
+    
+    for _, t := range trans {
+        sm.notify(func(l Listener){
+            l.AfterTransition(&sm.context, event, t.Transition)
+        })
+    }
+    
+    // the initial transition is saved after the status is running
+    if sm.IsRunning() {
+        sm.persist()
     }
 }
 
-// createTimeout creates timeout when enter this state.
-func (sm *StateMachine) createTimeout(state State) {
-    seconds := sm.timeouts[state.ID()]
+// exitStates exits the states one by one.
+func (sm *StateMachine) exitStates(ids []string) {
+    for _, id := range ids {
+        sm.cancelTimers(id)
+        sm.recordHistory(id)
+    }
     
-    if seconds <= 0 { return }
+    // exit actions
+    for _, id := range ids {
+        sm.dispatchActions(sm.exitActions[id])
+        sm.stateLocker.Lock()
+        delete(sm.active, id)
+        sm.stateLocker.Unlock()
+        sm.notify(func(l Listener){
+            l.OnStateExited(&sm.context, sm.states[id])
+        })
+    }
+}
+
+// enterStates enters the states one by one.
+func (sm *StateMachine) enterStates(ids []string) {
+    // entry actions
+    for _, id := range ids {
+        sm.stateLocker.Lock()
+        sm.active[id] = true
+        sm.stateLocker.Unlock()
+        sm.dispatchActions(sm.entryActions[id])
+        sm.notify(func(l Listener){
+            l.OnStateEntered(&sm.context, sm.states[id])
+        })
+    }
     
-    sm.timeoutChannel = make(chan int)
-    go func(){
-        timeout := time.After(time.Duration(seconds) * time.Second)
-        select{
-            case <-sm.timeoutChannel:
-                return
-            case <-timeout:
-                sm.timeoutChannel = nil
-                sm.SendEvent(sm.timeoutEvent)
+    for _, id := range ids {
+        if sm.finals[id] {
+            sm.raiseDoneEvents(id)
         }
-    }()
+    }
+    
+    // begin to count time for timeout after all entry actions
+    for _, id := range ids {
+        sm.startTimers(id)
+    }
+}
+
+// nextCurrentState returns the current state after exiting and entering states.
+func (sm *StateMachine) nextCurrentState(exits, entries []string) State{
+    ids := make(map[string]bool)
+    for id := range sm.active {
+        ids[id] = true
+    }
+    for _, id := range exits {
+        delete(ids, id)
+    }
+    for _, id := range entries {
+        ids[id] = true
+    }
+    
+    order := sm.documentOrder()
+    next := ""
+    for id := range ids {
+        if !sm.isCompound(id) && (next == "" || order[id] < order[next]) {
+            next = id
+        }
+    }
+    return sm.states[next]
+}
+
+// dispatchActions dispatches actions by action dispatcher one by one.
+func (sm *StateMachine) dispatchActions(actions []Action) {
+    for _, a := range actions {
+        sm.dispatchAction(a)
+    }
 }
 
-// cancelTimeout cancels the current timeout. 
-func (sm *StateMachine) cancelTimeout() {
-    if sm.timeoutChannel != nil {
-        sm.timeoutChannel <- 0
-        sm.timeoutChannel = nil
+// isSatisfied evaluates the condition of transition. The result is recorded if
+// there is a result recording, and listeners are notified. Should lock before
+// call this method.
+func (sm *StateMachine) isSatisfied(t *transitionDef) bool{
+    if sm.result == nil && len(sm.listeners) == 0 {
+        return sm.conditionEvaluator.IsSatisfied(t.Condition, &sm.context)
+    }
+
+    var ok bool
+    err := try(func(){
+        ok = sm.conditionEvaluator.IsSatisfied(t.Condition, &sm.context)
+    })
+    if sm.result != nil {
+        sm.result.Guards = append(sm.result.Guards, GuardResult{t.Transition, ok, err})
     }
+    sm.notify(func(l Listener){
+        l.OnGuardEvaluated(&sm.context, t.Transition, ok, err)
+    })
+    if err != nil {
+        panic(err)
+    }
+    return ok
+}
+
+// dispatchAction dispatches an action. It is recorded if there is a result
+// recording, and listeners are notified if it fails. Should lock before call
+// this method.
+func (sm *StateMachine) dispatchAction(a Action){
+    if sm.replaying { return }
+    if sm.result == nil && len(sm.listeners) == 0 {
+        sm.actionDispatcher.Dispatch(a, &sm.context)
+        return
+    }
+
+    err := try(func(){
+        sm.actionDispatcher.Dispatch(a, &sm.context)
+    })
+    if sm.result != nil {
+        sm.result.Actions = append(sm.result.Actions, ActionResult{a, err})
+    }
+    if err != nil {
+        sm.notify(func(l Listener){
+            l.OnActionFailed(&sm.context, a, err)
+        })
+        panic(err)
+    }
+}
+
+// SetClock sets the clock providing timers for timeouts. It should be set
+// before starting state machine, the default one uses package time.
+func (sm *StateMachine) SetClock(clock Clock) *StateMachine{
+    sm.clock = clock
+    return sm
+}
+
+// GetClock returns the clock of state machine.
+func (sm *StateMachine) GetClock() Clock{
+    return sm.clock
 }
 
 // SetInitialStateID sets the state machine's initial state's id.
 func (sm *StateMachine) SetInitialStateID(stateID string) *StateMachine{
+    sm.checkMutable()
     sm.initialStateID = stateID
     return sm
 }
@@ -364,33 +969,137 @@ func (sm *StateMachine) SetInitialStateID(stateID string) *StateMachine{
 // file. Before call this method, all states should be added to state machine
 // if not using DefaultState.
 func (sm *StateMachine) LoadConfig(configurer Configurer){
+    sm.checkMutable()
     configurer.configure(sm);
 }
 
 // Start starts the state machine, transform its state to initial state and 
 // begin to receive event.
 func (sm *StateMachine) Start(){
-    sm.locker.Lock()
-    defer sm.locker.Unlock()
+    sm.process(func(){
+        sm.checkEvicted()
+        sm.beginJournal(JOURNAL_START, nil)
+        sm.start()
+        sm.endJournal()
+    })
+}
+
+// start transforms state machine to initial state. Should lock before call this
+// method.
+func (sm *StateMachine) start(){
+    sm.reset()
     
-    sm.transitState(nil, sm.states[sm.initialStateID]);
-    sm.runStatus = STATUS_RUNNING;
+    var trans []*transitionDef
+    if sm.states[sm.initialStateID] != nil {
+        trans = append(trans, &transitionDef{Transition: Transition{TargetID: sm.initialStateID}})
+    }
+    sm.transitState(nil, trans);
+    sm.setRunStatus(STATUS_RUNNING)
+    sm.persist()
+    sm.notify(func(l Listener){
+        l.OnStarted(&sm.context)
+    })
+    sm.processInternalEvents()
+}
+
+// reset clears the histories, the internal and deferred events, and creates a
+// new done channel if it is closed, before starting. Should lock before call
+// this method.
+func (sm *StateMachine) reset(){
+    for id := range sm.historyValues {
+        delete(sm.historyValues, id)
+    }
+    sm.clearInternalEvents()
+    sm.setDeferredEvents(nil)
+    sm.renewDone()
 }
 
 // Stop stops the state machine, it exit its current state, and will not 
 // receive event any more.
 func (sm *StateMachine) Stop(){
-    sm.locker.Lock()
-    defer sm.locker.Unlock()
+    sm.process(func(){
+        sm.checkEvicted()
+        if sm.IsRunning() {
+            sm.beginJournal(JOURNAL_STOP, nil)
+        }
+        sm.stop(STATUS_STOPPED)
+        sm.endJournal()
+    })
+}
+
+// stop exits all active states and sets the status of state machine. Should
+// lock before call this method.
+func (sm *StateMachine) stop(status int){
+    running := sm.IsRunning()
+    
+    // exit from the last states
+    sm.setEvent(nil)
+    sm.exitStates(reverseStateIDs(sm.activeStateIDs()))
+    sm.stateLocker.Lock()
+    sm.previousState = sm.currentState
+    sm.currentState = nil
+    sm.stateLocker.Unlock()
+    sm.setRunStatus(status)
+    sm.clearInternalEvents()
+    sm.cancelAllScheduled()
+    sm.setDeferredEvents(nil)
+    sm.closeDone()
+    
+    if running {
+        sm.persist()
+        sm.notify(func(l Listener){
+            l.OnStopped(&sm.context, status)
+        })
+    }
+}
+
+// Done returns a channel that is closed when the state machine stops, either
+// by Stop() or by entering a top level final state. A new channel is created
+// when the state machine starts again. It can be called in actions and
+// listeners.
+func (sm *StateMachine) Done() <-chan struct{}{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
+    return sm.done
+}
+
+// renewDone creates a new done channel if it is closed. Should lock before call
+// this method.
+func (sm *StateMachine) renewDone(){
+    sm.stateLocker.Lock()
+    defer sm.stateLocker.Unlock()
     
-    // exit from the last state
-    sm.transitState(nil, nil);
-    sm.runStatus = STATUS_STOPPED;
+    select{
+        case <-sm.done:
+            sm.done = make(chan struct{})
+        default:
+    }
+}
+
+// closeDone closes the done channel if it is not closed. Should lock before
+// call this method.
+func (sm *StateMachine) closeDone(){
+    select{
+        case <-sm.done:
+        default:
+            close(sm.done)
+    }
+}
+
+// SetMaxEventlessSteps sets the max times of taking eventless transitions after
+// one event. If eventless transitions are still enabled after that, there may be
+// a cycle of conditions, the state machine panics with ConfigError.
+func (sm *StateMachine) SetMaxEventlessSteps(steps int) *StateMachine{
+    sm.checkMutable()
+    sm.maxEventlessSteps = steps
+    return sm
 }
 
 // SetTimeoutEvent set a timeout event to the state machine. When timeout 
 // happened, the event will be send to state machine.
 func (sm *StateMachine) SetTimeoutEvent(event Event) *StateMachine{
+    sm.checkMutable()
     sm.timeoutEvent = event
     return sm
 }
@@ -399,28 +1108,85 @@ func (sm *StateMachine) SetTimeoutEvent(event Event) *StateMachine{
 // happened, the state machine trans to this state if there has no corresponding
 // transition.
 func (sm *StateMachine) SetDefaultTimeoutStateID(stateID string) *StateMachine{
+    sm.checkMutable()
     sm.defaultTimeoutStateID = stateID
     return sm
 }
 
-// GetCurrentState return state machine's current state.
+// GetCurrentState return state machine's current state. When in parallel
+// states, it is the first one of current states, using GetActiveStates to get
+// all active states.
 func (sm *StateMachine) GetCurrentState() State{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
     return sm.currentState;
 }
 
+// GetParentState return the parent state of one state. It returns nil for
+// top level states.
+func (sm *StateMachine) GetParentState(state State) State{
+    if p, ok := sm.parents[state.ID()]; ok {
+        return sm.states[p]
+    }
+    return nil
+}
+
+// GetSubStates return the sub states of one state in the order of adding.
+func (sm *StateMachine) GetSubStates(state State) []State{
+    ids := sm.children[state.ID()]
+    states := make([]State, len(ids))
+    for i, id := range ids {
+        states[i] = sm.states[id]
+    }
+    return states
+}
+
+// GetActiveStates return all active states in document order, include the
+// current states of all regions and their ancestors.
+func (sm *StateMachine) GetActiveStates() []State{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
+    ids := sm.activeStateIDs()
+    states := make([]State, len(ids))
+    for i, id := range ids {
+        states[i] = sm.states[id]
+    }
+    return states
+}
+
+// IsInState return if the state is active, that is one of current states
+// or their ancestors.
+func (sm *StateMachine) IsInState(stateID string) bool{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
+    return sm.active[stateID]
+}
+
 // GetPreviousState return state machine's previous state.
 func (sm *StateMachine) GetPreviousState() State{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
     return sm.previousState;
 }
 
 // GetNextState return state machine's next state. It's nil normally.
 // Only when transforming, the next state is the new target state. 
 func (sm *StateMachine) GetNextState() State{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
     return sm.nextState;
 }
 
 // GetEvent return the event recieved by state machine now.
 func (sm *StateMachine) GetEvent() Event{
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
     return sm.event;
 }
 
@@ -441,13 +1207,47 @@ func (sm *StateMachine) getState(id string) State{
     return sm.states[id]
 }
 
+// setRunStatus sets the status of state machine.
+func (sm *StateMachine) setRunStatus(status int){
+    sm.stateLocker.Lock()
+    defer sm.stateLocker.Unlock()
+    
+    sm.runStatus = status
+}
+
+// setEvent sets the event that state machine is processing.
+func (sm *StateMachine) setEvent(event Event){
+    sm.stateLocker.Lock()
+    defer sm.stateLocker.Unlock()
+    
+    sm.event = event
+}
+
 // IsRunning return if the state machine is running or not.
 func (sm *StateMachine) IsRunning() bool {
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
     return sm.runStatus == STATUS_RUNNING
 }
 
-// GetTimeout return the timeout seconds of one state.
+// IsFinished return if the state machine stopped itself by entering a top
+// level final state.
+func (sm *StateMachine) IsFinished() bool {
+    sm.stateLocker.RLock()
+    defer sm.stateLocker.RUnlock()
+    
+    return sm.runStatus == STATUS_FINISHED
+}
+
+// GetTimeout return the timeout seconds of one state. The fraction of a second
+// is truncated, use GetTimeoutDuration to get the exact timeout.
 func (sm *StateMachine) GetTimeout(state State) int {
+    return int(sm.timeouts[state.ID()] / time.Second)
+}
+
+// GetTimeoutDuration return the timeout of one state.
+func (sm *StateMachine) GetTimeoutDuration(state State) time.Duration {
     return sm.timeouts[state.ID()]
 }
 
@@ -470,6 +1270,26 @@ func (c *Context) GetAttributes() map[Any]Any{
     return c.attributes
 }
 
+// GetEvent return the event that state machine is processing.
+func (c *Context) GetEvent() Event{
+    return c.stateMachine.event
+}
+
+// GetEventData return the data value by name from the event that state machine
+// is processing. It returns nil if the event is not a DataEvent.
+func (c *Context) GetEventData(name string) Any{
+    if e, ok := c.stateMachine.event.(DataEvent); ok {
+        return e.Data()[name]
+    }
+    return nil
+}
+
+// Raise raises an event to state machine's internal event queue, it is
+// processed after the current transition. See StateMachine.Raise.
+func (c *Context) Raise(event Event){
+    c.stateMachine.Raise(event)
+}
+
 // GetAttribute return the attribute value by key get attribute from context.
 func (c *Context) GetAttribute(key Any) Any{
     return c.attributes[key]
@@ -0,0 +1,269 @@
+package hackberry
+
+import (
+    "bytes"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+)
+
+// Store saves the snapshots of state machines by their ids. Each saving makes
+// a new version of the snapshot, the version is checked when saving and
+// deleting, so a snapshot is not overwritten by one who didn't load the latest
+// version.
+type Store interface{
+    // Save saves the snapshot of id if the stored version is version, which is
+    // 0 if there is no snapshot of id. It returns the new version, or returns
+    // ErrVersionConflict if the stored version is another one.
+    Save(id string, data []byte, version int64) (int64, error)
+
+    // Load returns the snapshot of id and its version, or returns ErrNotFound.
+    Load(id string) ([]byte, int64, error)
+
+    // Delete deletes the snapshot of id if the stored version is version. It
+    // returns ErrNotFound if there is no snapshot of id, or ErrVersionConflict
+    // if the stored version is another one.
+    Delete(id string, version int64) error
+}
+
+// memoryStore implements Store in memory.
+type memoryStore struct{
+    snapshots map[string]storedSnapshot
+    locker sync.Mutex
+}
+
+// storedSnapshot is a snapshot with its version.
+type storedSnapshot struct{
+    data []byte
+    version int64
+}
+
+// NewMemoryStore creates a store that keeps snapshots in memory, it can be used
+// in tests or by state machines of one process.
+func NewMemoryStore() Store{
+    return &memoryStore{snapshots: make(map[string]storedSnapshot)}
+}
+
+func (s *memoryStore) Save(id string, data []byte, version int64) (int64, error){
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    if s.snapshots[id].version != version {
+        return 0, ErrVersionConflict
+    }
+    s.snapshots[id] = storedSnapshot{append([]byte(nil), data...), version + 1}
+    return version + 1, nil
+}
+
+func (s *memoryStore) Load(id string) ([]byte, int64, error){
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    o, ok := s.snapshots[id]
+    if !ok {
+        return nil, 0, ErrNotFound
+    }
+    return append([]byte(nil), o.data...), o.version, nil
+}
+
+func (s *memoryStore) Delete(id string, version int64) error{
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    o, ok := s.snapshots[id]
+    if !ok {
+        return ErrNotFound
+    }
+    if o.version != version {
+        return ErrVersionConflict
+    }
+    delete(s.snapshots, id)
+    return nil
+}
+
+// fileStore implements Store by files in a directory. Each snapshot is a file,
+// its first line is the version.
+type fileStore struct{
+    dir string
+    locker sync.Mutex
+}
+
+// NewFileStore creates a store that saves snapshots as files in the directory,
+// the directory is created when saving if it doesn't exist. A file is written
+// to a temporary file first and then renamed, so it is never written partly.
+// Versions are checked in the process, a directory should not be shared by
+// the stores of several processes.
+func NewFileStore(dir string) Store{
+    return &fileStore{dir: dir}
+}
+
+// path returns the file path of id, the id is escaped so that it can't be out
+// of the directory.
+func (s *fileStore) path(id string) string{
+    return filepath.Join(s.dir, url.PathEscape(id) + ".snapshot")
+}
+
+// read reads the snapshot of id, the version is 0 if there is no one.
+func (s *fileStore) read(id string) ([]byte, int64, error){
+    content, err := os.ReadFile(s.path(id))
+    if os.IsNotExist(err) {
+        return nil, 0, nil
+    }
+    if err != nil {
+        return nil, 0, &StoreError{Message: "Can't read snapshot of [" + id + "].", Cause: err}
+    }
+
+    i := bytes.IndexByte(content, '\n')
+    if i < 0 {
+        return nil, 0, &StoreError{Message: "Snapshot file of [" + id + "] has no version."}
+    }
+    version, err := strconv.ParseInt(string(content[:i]), 10, 64)
+    if err != nil {
+        return nil, 0, &StoreError{Message: "Can't parse version of snapshot of [" + id + "].", Cause: err}
+    }
+    return content[i + 1:], version, nil
+}
+
+func (s *fileStore) Save(id string, data []byte, version int64) (int64, error){
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    if _, v, err := s.read(id); err != nil {
+        return 0, err
+    }else if v != version {
+        return 0, ErrVersionConflict
+    }
+
+    if err := os.MkdirAll(s.dir, 0755); err != nil {
+        return 0, &StoreError{Message: "Can't create directory [" + s.dir + "].", Cause: err}
+    }
+    if err := s.write(id, data, version + 1); err != nil {
+        return 0, &StoreError{Message: "Can't write snapshot of [" + id + "].", Cause: err}
+    }
+    return version + 1, nil
+}
+
+// write writes the snapshot to a temporary file, and then renames it to the
+// file of id. The directory is synced after renaming, so that the renaming is
+// not lost by a crash.
+func (s *fileStore) write(id string, data []byte, version int64) error{
+    f, err := os.CreateTemp(s.dir, url.PathEscape(id) + ".*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(f.Name())
+
+    content := append([]byte(strconv.FormatInt(version, 10) + "\n"), data...)
+    if _, err := f.Write(content); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(f.Name(), s.path(id)); err != nil {
+        return err
+    }
+    return syncDir(s.dir)
+}
+
+// syncDir commits the entries of a directory to disk.
+func syncDir(dir string) error{
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+
+    return d.Sync()
+}
+
+func (s *fileStore) Load(id string) ([]byte, int64, error){
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    data, version, err := s.read(id)
+    if err == nil && version == 0 {
+        err = ErrNotFound
+    }
+    return data, version, err
+}
+
+func (s *fileStore) Delete(id string, version int64) error{
+    s.locker.Lock()
+    defer s.locker.Unlock()
+
+    _, v, err := s.read(id)
+    if err != nil {
+        return err
+    }
+    if v == 0 {
+        return ErrNotFound
+    }
+    if v != version {
+        return ErrVersionConflict
+    }
+    if err := os.Remove(s.path(id)); err != nil {
+        return &StoreError{Message: "Can't delete snapshot of [" + id + "].", Cause: err}
+    }
+    return nil
+}
+
+// SetStore sets the store and the id of state machine, then state machine saves
+// its snapshot to the store after each transition, and after starting and
+// stopping. If saving fails, the state machine panics with the error, which
+// can be got by TrySendEvent. The version saved is kept to check the next
+// saving, so only one state machine can save the snapshot of an id. It should
+// be set before starting or restoring state machine.
+func (sm *StateMachine) SetStore(store Store, id string) *StateMachine{
+    sm.store = store
+    sm.storeID = id
+    sm.storeVersion = 0
+    return sm
+}
+
+// RestoreFromStore restores state machine from the snapshot of its id in the
+// store, see Restore. It returns ErrNotFound if there is no snapshot.
+func (sm *StateMachine) RestoreFromStore() error{
+    if sm.store == nil {
+        return &StoreError{Message: "Has no store."}
+    }
+
+    data, version, err := sm.store.Load(sm.storeID)
+    if err != nil {
+        return err
+    }
+    s, err := decodeSnapshot(data)
+    if err != nil {
+        return err
+    }
+
+    sm.process(func(){
+        if err = sm.restore(s, 0); err == nil {
+            sm.storeVersion = version
+        }
+    })
+    return err
+}
+
+// persist saves the snapshot of state machine to its store if there is one,
+// but not when replaying a journal. Should lock before call this method.
+func (sm *StateMachine) persist(){
+    if sm.store == nil || sm.replaying { return }
+
+    data, err := sm.snapshot()
+    if err != nil {
+        panic(err)
+    }
+    version, err := sm.store.Save(sm.storeID, data, sm.storeVersion)
+    if err != nil {
+        panic(err)
+    }
+    sm.storeVersion = version
+}
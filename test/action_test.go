@@ -148,3 +148,50 @@ func TestActionParameters(t *testing.T){
 	sm.SendEvent(e1)
 	verify(t, "TestActionParameters", d.result, exp)
 }
+
+// test actions executed by transition
+func TestTransitionAction(t *testing.T){
+	d := &testDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states)
+	sm.SetInitialStateID("s1")
+	sm.AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"a1", nil}, Action{"a2", []Any{"v1"}})
+	sm.AddTransition(Transition{SourceID: "s2", TargetID: "s1", EventName: "e2"})
+	sm.AddOnExit("s1", Action{"a3", nil})
+	sm.AddOnEntry("s2", Action{"a4", nil})
+	sm.Start()
+	
+	exp := "s1|e1|a3|" + "s1|e1|a1|" + "s1|e1|a2|v1|" + "s2|e1|a4|"
+	d.result = ""
+	sm.SendEvent(e1)
+	verify(t, "TestTransitionAction 1", d.result, exp)
+	
+	// transition without action
+	d.result = ""
+	sm.SendEvent(e2)
+	verify(t, "TestTransitionAction 2", d.result, "")
+}
+
+func TestTransitionActionNoDispatcher(t *testing.T){
+	expected := "Has no action dispatcher."
+	defer verifyPanic(t, "TestTransitionActionNoDispatcher", (*ConfigError)(nil), expected)
+	
+	sm := NewStateMachine(nil, nil)
+	sm.AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"a1", nil})
+}
+
+// test configured actions executed by transition
+func TestConfigFileTransitionAction(t *testing.T){
+	for _, cfg := range []Configurer{NewConfigurerXML(dir + "stateMachine_transitionAction.xml"),
+			NewConfigurerJSON(dir + "stateMachine_transitionAction.json")} {
+		d := &testDispatcher{}
+		sm := NewStateMachine(nil, d)
+		sm.LoadConfig(cfg)
+		sm.Start()
+		
+		exp := "s1|e1|a1|" + "s1|e1|a2|abc|" + "s2|e1|a3|"
+		d.result = ""
+		sm.SendEvent(e1)
+		verify(t, "TestConfigFileTransitionAction", d.result, exp)
+	}
+}
@@ -0,0 +1,59 @@
+package test
+
+import (
+    "testing"
+    "time"
+    . ".."
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	result := ""
+	clock.AfterFunc(2 * time.Second, func(){ result += "2|" })
+	clock.AfterFunc(time.Second, func(){
+		result += "1|"
+		// due in the same advance
+		clock.AfterFunc(500 * time.Millisecond, func(){ result += "1.5|" })
+	})
+	stopped := clock.AfterFunc(time.Second, func(){ result += "stopped|" })
+	verify(t, "TestManualClock 1", stopped.Stop(), true)
+	verify(t, "TestManualClock 2", stopped.Stop(), false)
+
+	clock.Advance(1500 * time.Millisecond)
+	verify(t, "TestManualClock 3", result, "1|1.5|")
+	verify(t, "TestManualClock 4", clock.Now(), start.Add(1500 * time.Millisecond))
+	verify(t, "TestManualClock 5", clock.PendingTimers(), 1)
+
+	clock.Advance(time.Second)
+	verify(t, "TestManualClock 6", result, "1|1.5|2|")
+	verify(t, "TestManualClock 7", clock.PendingTimers(), 0)
+}
+
+// long timeouts can be tested without waiting
+func TestManualClockTimeout(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  SetTimeoutEvent(timeoutEvent).
+	  AddTimeout("s1", 1800).
+	  AddTimeout("s2", 60).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "timeoutEvt"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "timeoutEvt"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s1", EventName: "e1"})
+	verify(t, "TestManualClockTimeout 1", sm.GetClock(), Clock(clock))
+	sm.Start()
+
+	clock.Advance(29 * time.Minute)
+	verify(t, "TestManualClockTimeout 2", sm.GetCurrentState().ID(), "s1")
+	clock.Advance(time.Minute)
+	verify(t, "TestManualClockTimeout 3", sm.GetCurrentState().ID(), "s2")
+
+	// the timeout of s2 is cancelled when exiting it
+	sm.SendEvent(e1)
+	verify(t, "TestManualClockTimeout 4", clock.PendingTimers(), 1)
+	clock.Advance(time.Hour)
+	verify(t, "TestManualClockTimeout 5", sm.GetCurrentState().ID(), "s3")
+}
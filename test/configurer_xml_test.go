@@ -112,6 +112,8 @@ func TestConfigFileParaCondition(t *testing.T) {
 	
 	a1.result = ""
 	a2.result = ""
+	clock := NewManualClock(time.Now())
+	sm.SetClock(clock)
 	sm.Start();
 	sm.SendEvent(e1)
 	exp1 := "M1|M2|abc|123|true|456.789000|"
@@ -124,6 +126,6 @@ func TestConfigFileParaCondition(t *testing.T) {
 	verify(t, "TestConfigFileParaCondition 3", sm.GetCurrentState().ID(), "s1")
 	
 	// default timeout state
-	time.Sleep(1200 * time.Millisecond)
+	clock.Advance(1200 * time.Millisecond)
 	verify(t, "TestConfigFileParaCondition 3", sm.GetCurrentState().ID(), "s4")
 }
@@ -0,0 +1,108 @@
+package test
+
+import (
+    "fmt"
+    "testing"
+    . ".."
+)
+
+var syncEvt, syncedEvt, saveEvt, editEvt Event = &myEvent{"sync"}, &myEvent{"synced"}, &myEvent{"save"}, &myEvent{"edit.text"}
+
+func verifyDeferConfig(t *testing.T, name string, sm *StateMachine) {
+	sm.Start()
+	sm.SendEvent(syncEvt)
+	sm.SendEvent(saveEvt)
+	sm.SendEvent(editEvt)
+	verify(t, name + " 1", sm.GetCurrentState().ID(), "syncing")
+	verify(t, name + " 2", len(sm.GetDeferredEvents()), 2)
+	
+	// save is offered first, then edit.text in saved state
+	sm.SendEvent(syncedEvt)
+	verify(t, name + " 3", sm.GetCurrentState().ID(), "idle")
+	verify(t, name + " 4", sm.GetPreviousState().ID(), "saved")
+	verify(t, name + " 5", len(sm.GetDeferredEvents()), 0)
+}
+
+func TestConfigFileDeferXML(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.LoadConfig(NewConfigurerXML(dir + "stateMachine_defer.xml"))
+	verify(t, "TestConfigFileDeferXML", fmt.Sprint(sm.GetDefers(&myState{"syncing"})), "[save edit.*]")
+	verifyDeferConfig(t, "TestConfigFileDeferXML", sm)
+}
+
+func TestConfigFileDeferJSON(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.LoadConfig(NewConfigurerJSON(dir + "stateMachine_defer.json"))
+	verifyDeferConfig(t, "TestConfigFileDeferJSON", sm)
+}
+
+// transitions of the deferring state take precedence, events deferred by a
+// parent state are kept in its sub states
+func TestDeferWithTransition(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates([]State{s1, s4, s5, s6}).
+	  AddSubStates("s1", []State{s2, s3}).
+	  SetInitialStateID("s1").
+	  AddDefer("s1", "e1", "e2").
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"}).
+	  AddTransition(Transition{SourceID: "s3", TargetID: "s4", EventName: "e3"}).
+	  AddTransition(Transition{SourceID: "s4", TargetID: "s5", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s4", TargetID: "s6", EventName: "e2"})
+	sm.Start()
+	
+	sm.SendEvent(e2)
+	verify(t, "TestDeferWithTransition 1", sm.GetCurrentState().ID(), "s3")
+	sm.SendEvent(e1)
+	sm.SendEvent(e2)
+	verify(t, "TestDeferWithTransition 2", len(sm.GetDeferredEvents()), 2)
+	
+	// e1 enables s4 -> s5, then e2 is dropped in s5
+	sm.SendEvent(e3)
+	verify(t, "TestDeferWithTransition 3", sm.GetCurrentState().ID(), "s5")
+	verify(t, "TestDeferWithTransition 4", len(sm.GetDeferredEvents()), 0)
+}
+
+// deferred events are discarded when stopping
+func TestDeferStop(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddDefer("s1", "*")
+	sm.Start()
+	sm.SendEvent(e1)
+	verify(t, "TestDeferStop 1", len(sm.GetDeferredEvents()), 1)
+	sm.Stop()
+	verify(t, "TestDeferStop 2", len(sm.GetDeferredEvents()), 0)
+}
+
+func TestDeferNoState(t *testing.T) {
+	defer verifyPanic(t, "TestDeferNoState", (*ConfigError)(nil), "Has no state [s7].")
+	NewStateMachine(nil, nil).AddStates(states).AddDefer("s7", "e1")
+}
+
+// deferListener reads the deferred events while processing.
+type deferListener struct{
+	DefaultListener
+	deferred int
+}
+
+func (l *deferListener) OnStateEntered(c *Context, state State){
+	l.deferred = len(c.GetStateMachine().GetDeferredEvents())
+}
+
+// the deferred events can be read by listeners while processing
+func TestDeferredEventsInListener(t *testing.T) {
+	l := &deferListener{}
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddDefer("s1", "e2").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddListener(l)
+	sm.Start()
+
+	sm.SendEvent(e2)
+	sm.SendEvent(e1)
+	verify(t, "TestDeferredEventsInListener 1", l.deferred, 1)
+	verify(t, "TestDeferredEventsInListener 2", len(sm.GetDeferredEvents()), 0)
+}
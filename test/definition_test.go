@@ -0,0 +1,193 @@
+package test
+
+import (
+    "sync"
+    "testing"
+    . ".."
+)
+
+// configureOrder configures the order machine: s1 -e1-> s2 -e2-> s3, s3 goes
+// to s4 when n>1
+func configureOrder(sm *StateMachine) {
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"}).
+	  AddTransition(Transition{SourceID: "s3", TargetID: "s4", Condition: "n>1"})
+}
+
+func newOrderDefinition(t testing.TB) *Definition {
+	def, err := NewDefinition(NewDefaultConditionEvaluator(), &counterDispatcher{}, configureOrder)
+	if err != nil {
+		t.Fatalf("newOrderDefinition: %v", err)
+	}
+	return def
+}
+
+func TestDefinition(t *testing.T) {
+	def := newOrderDefinition(t)
+	verify(t, "TestDefinition 1", def.GetInitialStateID(), "s1")
+
+	sm1 := def.NewStateMachine()
+	sm2 := def.NewStateMachine()
+	sm1.GetContext().SetAttribute("n", 2)
+	sm1.Start()
+	sm2.Start()
+	sm1.SendEvent(e1)
+	sm1.SendEvent(e2)
+	sm2.SendEvent(e1)
+	verify(t, "TestDefinition 2", sm1.GetCurrentState().ID(), "s4")
+	verify(t, "TestDefinition 3", sm2.GetCurrentState().ID(), "s2")
+	verify(t, "TestDefinition 4", sm2.GetContext().GetAttribute("n"), nil)
+}
+
+func TestDefinitionFrozen(t *testing.T) {
+	def := newOrderDefinition(t)
+	sm := def.NewStateMachine()
+
+	defer verifyPanic(t, "TestDefinitionFrozen", (*ConfigError)(nil),
+		"The definition of state machine is frozen, it can't be changed.")
+	sm.AddTransition(Transition{SourceID: "s1", TargetID: "s3", EventName: "e3"})
+}
+
+// the configuration of a state machine can be frozen to a definition too
+func TestDefinitionOfStateMachine(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"})
+	def, err := sm.Definition()
+	verifyNil(t, "TestDefinitionOfStateMachine 1", err)
+	err = sm.Configure(func(sm *StateMachine){
+		sm.SetInitialStateID("s2")
+	})
+	verify(t, "TestDefinitionOfStateMachine 2", err != nil, true)
+
+	sm2 := def.NewStateMachine()
+	sm2.Start()
+	sm2.SendEvent(e1)
+	verify(t, "TestDefinitionOfStateMachine 3", sm2.GetCurrentState().ID(), "s2")
+}
+
+func TestDefinitionValidate(t *testing.T) {
+	_, err := NewDefinition(nil, nil, func(sm *StateMachine){
+		sm.AddStates(states)
+	})
+	verify(t, "TestDefinitionValidate 1", err.Error(), "Has no initial state [].")
+
+	_, err = NewDefinition(nil, nil, func(sm *StateMachine){
+		sm.AddStates(states).
+		  SetInitialStateID("s1").
+		  AddTransition(Transition{SourceID: "s1", TargetID: "s9", EventName: "e1"})
+	})
+	verify(t, "TestDefinitionValidate 2", err.Error(), "Has no target state [s9] of transition.")
+
+	_, err = NewDefinition(nil, nil, func(sm *StateMachine){
+		sm.AddStates(states).
+		  SetInitialStateID("s1").
+		  AddDefer("s9", "e1")
+	})
+	verify(t, "TestDefinitionValidate 3", err.Error(), "Has no state [s9].")
+}
+
+func TestDefinitionConfigFile(t *testing.T) {
+	def, err := NewDefinition(NewDefaultConditionEvaluator(), NewDefaultActionDispatcher(), func(sm *StateMachine){
+		sm.AddStates(states).
+		  SetTimeoutEvent(timeoutEvent).
+		  LoadConfig(NewConfigurerXML(dir + "stateMachine.xml"))
+	})
+	verifyNil(t, "TestDefinitionConfigFile 1", err)
+	verify(t, "TestDefinitionConfigFile 2", def.GetInitialStateID(), "s1")
+}
+
+// the state machines of a definition run concurrently, run with -race
+func TestDefinitionConcurrently(t *testing.T) {
+	def := newOrderDefinition(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			sm := def.NewStateMachine()
+			sm.GetContext().SetAttribute("n", 2)
+			sm.Start()
+			sm.SendEvent(e1)
+			sm.SendEvent(e2)
+			if !sm.IsInState("s4") {
+				t.Errorf("TestDefinitionConcurrently: state is %s", sm.GetCurrentState().ID())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// newConfiguredMachine creates a state machine by config file as before.
+func newConfiguredMachine() *StateMachine {
+	sm := NewStateMachine(NewDefaultConditionEvaluator(), NewDefaultActionDispatcher())
+	sm.AddStates(states).
+	  SetTimeoutEvent(timeoutEvent).
+	  LoadConfig(NewConfigurerXML(dir + "stateMachine.xml"))
+	return sm
+}
+
+// machineSink keeps the state machines created by benchmarks, so that they
+// are allocated on heap as in applications.
+var machineSink *StateMachine
+
+// BenchmarkNewStateMachine configures each state machine by config file, it
+// is compared with BenchmarkDefinitionNewStateMachine by -benchmem. It includes
+// parsing the file.
+func BenchmarkNewStateMachine(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		machineSink = newConfiguredMachine()
+	}
+}
+
+// BenchmarkDefinitionNewStateMachine creates state machines of a definition
+// configured by the same file.
+func BenchmarkDefinitionNewStateMachine(b *testing.B) {
+	def, _ := newConfiguredMachine().Definition()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		machineSink = def.NewStateMachine()
+	}
+}
+
+// BenchmarkNewStateMachineByCode configures each order machine by methods, it
+// is compared with BenchmarkDefinitionNewOrderMachine to measure the memory
+// saved by sharing the configuration without parsing files.
+func BenchmarkNewStateMachineByCode(b *testing.B) {
+	ce, d := NewDefaultConditionEvaluator(), &counterDispatcher{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm := NewStateMachine(ce, d)
+		configureOrder(sm)
+		machineSink = sm
+	}
+}
+
+// BenchmarkDefinitionNewOrderMachine creates order machines of a definition.
+func BenchmarkDefinitionNewOrderMachine(b *testing.B) {
+	def := newOrderDefinition(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		machineSink = def.NewStateMachine()
+	}
+}
+
+// BenchmarkDefinitionRun creates a state machine of a definition and runs it.
+func BenchmarkDefinitionRun(b *testing.B) {
+	def := newOrderDefinition(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm := def.NewStateMachine()
+		sm.Start()
+		sm.SendEvent(e1)
+		sm.SendEvent(e2)
+	}
+}
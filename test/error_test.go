@@ -0,0 +1,193 @@
+package test
+
+import (
+    "errors"
+    "os"
+    "encoding/xml"
+    "strconv"
+    "testing"
+    "time"
+    . ".."
+)
+
+// the error types implement error and wrap their causes
+func TestErrorInterface(t *testing.T) {
+	cause := errors.New("cause")
+	var err error = &ConfigError{Message: "Config failed.", Cause: cause}
+	verify(t, "TestErrorInterface 1", err.Error(), "Config failed.: cause")
+	verify(t, "TestErrorInterface 2", errors.Is(err, cause), true)
+	verify(t, "TestErrorInterface 3", errors.Unwrap(err), cause)
+
+	err = &ActionError{Message: "Action failed."}
+	verify(t, "TestErrorInterface 4", err.Error(), "Action failed.")
+	verify(t, "TestErrorInterface 5", errors.Unwrap(err), nil)
+	err = &ConditionError{Message: "Condition failed."}
+	verify(t, "TestErrorInterface 6", err.Error(), "Condition failed.")
+	err = &ParseError{Message: "Parse failed."}
+	verify(t, "TestErrorInterface 7", err.Error(), "Parse failed.")
+	err = NewConfigError("Config failed.", cause)
+	verify(t, "TestErrorInterface 8", err.Error(), "Config failed.: cause")
+	verify(t, "TestErrorInterface 9", errors.Is(err, cause), true)
+}
+
+func TestNewConfigurerE(t *testing.T) {
+	_, err := NewConfigurerXMLE(dir + "none.xml")
+	var ce *ConfigError
+	verify(t, "TestNewConfigurerE 1", errors.As(err, &ce), true)
+	verify(t, "TestNewConfigurerE 2", errors.Is(err, os.ErrNotExist), true)
+
+	_, err = NewConfigurerXMLE(dir + "stateMachine_parseError.xml")
+	var se *xml.SyntaxError
+	verify(t, "TestNewConfigurerE 3", errors.As(err, &se), true)
+
+	_, err = NewConfigurerJSONE(dir + "none.json")
+	verify(t, "TestNewConfigurerE 4", errors.Is(err, os.ErrNotExist), true)
+
+	c, err := NewConfigurerXMLE(dir + "stateMachine.xml")
+	verifyNil(t, "TestNewConfigurerE 5", err)
+	verify(t, "TestNewConfigurerE 6", c != nil, true)
+}
+
+func TestLoadConfigE(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	err := sm.LoadConfigE(NewConfigurerXML(dir + "stateMachine_noState.xml"))
+	var ce *ConfigError
+	verify(t, "TestLoadConfigE 1", errors.As(err, &ce), true)
+
+	err = sm.LoadConfigE(nil)
+	verify(t, "TestLoadConfigE 2", errors.As(err, &ce), true)
+	verify(t, "TestLoadConfigE 3", ce.Message, "Configurer is nil!")
+
+	sm = NewStateMachine(nil, nil)
+	verifyNil(t, "TestLoadConfigE 4", sm.LoadConfigE(NewConfigurerXML(dir + "stateMachine_defer.xml")))
+}
+
+func TestConfigureE(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	err := sm.AddTransitionE(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1", Condition: "x=1"})
+	var ce *ConfigError
+	verify(t, "TestConfigureE 1", errors.As(err, &ce), true)
+	verify(t, "TestConfigureE 2", ce.Message, "Has no condition evaluator.")
+
+	verify(t, "TestConfigureE 3", sm.AddOnEntryE("s1", Action{"a1", nil}) != nil, true)
+	verify(t, "TestConfigureE 4", sm.AddOnExitE("s1", Action{"a1", nil}) != nil, true)
+	verify(t, "TestConfigureE 5", sm.AddTimeoutE("s1", 5) != nil, true)
+
+	err = sm.Configure(func(sm *StateMachine){
+		sm.AddStates(states).SetFinal("s7")
+	})
+	verify(t, "TestConfigureE 6", errors.As(err, &ce), true)
+	verify(t, "TestConfigureE 7", ce.Message, "Has no state [s7].")
+	verifyNil(t, "TestConfigureE 8", sm.AddTransitionE(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}))
+}
+
+func TestTrySendEvent(t *testing.T) {
+	dispatcher := NewDefaultActionDispatcher()
+	dispatcher.AddActionExecutor("payment", &paymentExecutor{})
+	sm := NewStateMachine(nil, dispatcher)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "refund"},
+	  	Action{"payment.Refund", []Any{"_event.userID", "_event.amount"}})
+	verify(t, "TestTrySendEvent 1", sm.TrySendEvent(e1), ErrNotRunning)
+	verifyNil(t, "TestTrySendEvent 2", sm.TryStart())
+
+	err := sm.TrySendEvent(NewDefaultEvent("refund", map[string]Any{"userID": "u1", "amount": "x"}))
+	var ae *ActionError
+	var pe *ParseError
+	var ne *strconv.NumError
+	verify(t, "TestTrySendEvent 3", errors.As(err, &ae), true)
+	verify(t, "TestTrySendEvent 4", ae.Message, "Can't convert parameter for method [payment.Refund].")
+	verify(t, "TestTrySendEvent 5", errors.As(err, &pe), true)
+	verify(t, "TestTrySendEvent 6", errors.As(err, &ne), true)
+
+	// the state machine still works after an error
+	verifyNil(t, "TestTrySendEvent 7", sm.TryStop())
+	verifyNil(t, "TestTrySendEvent 8", sm.TryStart())
+	verifyNil(t, "TestTrySendEvent 9", sm.TrySendEvent(NewDefaultEvent("refund", map[string]Any{"userID": "u1", "amount": 100})))
+	verify(t, "TestTrySendEvent 10", sm.GetCurrentState().ID(), "s2")
+}
+
+func TestIsSatisfiedE(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.GetContext().SetAttribute("x", 1)
+	ce := NewDefaultConditionEvaluator()
+	ok, err := ce.IsSatisfiedE("x=1", sm.GetContext())
+	verify(t, "TestIsSatisfiedE 1", ok, true)
+	verifyNil(t, "TestIsSatisfiedE 2", err)
+
+	_, err = ce.IsSatisfiedE("x=a", sm.GetContext())
+	var ee *ConditionError
+	var pe *ParseError
+	verify(t, "TestIsSatisfiedE 3", errors.As(err, &ee), true)
+	verify(t, "TestIsSatisfiedE 4", errors.As(err, &pe), true)
+
+	_, err = ce.IsSatisfiedE("x", sm.GetContext())
+	verify(t, "TestIsSatisfiedE 5", errors.As(err, &ee), true)
+}
+
+func TestDispatchE(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	ad := NewDefaultActionDispatcher()
+	err := ad.DispatchE(Action{"a1", nil}, sm.GetContext())
+	var ae *ActionError
+	verify(t, "TestDispatchE 1", errors.As(err, &ae), true)
+
+	ad.AddActionExecutor("payment", &paymentExecutor{})
+	verifyNil(t, "TestDispatchE 2", ad.DispatchE(Action{"payment.Refund", []Any{"u1", 100}}, sm.GetContext()))
+}
+
+// blockDispatcher blocks in the action "slow" until it is released, and panics
+// in the action "fail".
+type blockDispatcher struct{
+	started chan bool
+	release chan bool
+}
+
+func (d *blockDispatcher) Dispatch(a Action, c *Context){
+	switch a.Name {
+		case "slow":
+			d.started <- true
+			<-d.release
+		case "fail":
+			panic(&ActionError{Message: "Action failed."})
+	}
+}
+
+// failedListener records the events failed and their errors.
+type failedListener struct{
+	DefaultListener
+	failed chan string
+}
+
+func (l *failedListener) OnEventFailed(c *Context, event Event, err error){
+	l.failed <- event.Name() + ":" + err.Error()
+}
+
+// the error of an event queued while a timer event is processing is reported
+// to listeners, it doesn't panic in the goroutine of clock
+func TestTrySendEventQueued(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	d := &blockDispatcher{make(chan bool), make(chan bool)}
+	l := &failedListener{failed: make(chan string, 1)}
+	sm := NewStateMachine(nil, d)
+	sm.SetClock(clock)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddStateTimer("s1", StateTimer{Name: "slow", Delay: time.Second, Event: e1}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"slow", nil}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"}, Action{"fail", nil}).
+	  AddListener(l)
+	sm.Start()
+
+	advanced := make(chan bool)
+	go func(){
+		clock.Advance(time.Second)
+		advanced <- true
+	}()
+	<-d.started
+	verifyNil(t, "TestTrySendEventQueued 1", sm.TrySendEvent(e2))
+	d.release <- true
+	<-advanced
+	verify(t, "TestTrySendEventQueued 2", <-l.failed, "e2:Action failed.")
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+    "testing"
+    . ".."
+)
+
+type paymentExecutor struct {
+	result string
+}
+
+func (pe *paymentExecutor)Refund(userID string, amount int){
+	pe.result += userID + "|" + string(rune('0' + amount / 100)) + "|"
+}
+
+// conditions use event data
+func TestEventDataCondition(t *testing.T) {
+	sm := NewStateMachine(NewDefaultConditionEvaluator(), nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "pay", Condition: "_event.amount>100"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s3", EventName: "pay", Condition: "amount>100"})
+	sm.GetContext().SetAttribute("amount", 50)
+	sm.Start()
+	
+	sm.SendEvent(NewDefaultEvent("pay", map[string]Any{"amount": 80}))
+	verify(t, "TestEventDataCondition 1", sm.GetCurrentState().ID(), "s1")
+	
+	// event without data
+	sm.SendEvent(NewDefaultEvent("pay", nil))
+	verify(t, "TestEventDataCondition 2", sm.GetCurrentState().ID(), "s1")
+	sm.SendEvent(pay)
+	verify(t, "TestEventDataCondition 3", sm.GetCurrentState().ID(), "s1")
+	
+	sm.SendEvent(NewDefaultEvent("pay", map[string]Any{"amount": 120}))
+	verify(t, "TestEventDataCondition 4", sm.GetCurrentState().ID(), "s2")
+	verify(t, "TestEventDataCondition 5", sm.GetContext().GetEventData("amount"), 120)
+	verify(t, "TestEventDataCondition 6", sm.GetContext().GetEvent().Name(), "pay")
+}
+
+// action parameters use event data
+func TestEventDataParameter(t *testing.T) {
+	pe := &paymentExecutor{}
+	dispatcher := NewDefaultActionDispatcher()
+	dispatcher.AddActionExecutor("payment", pe)
+	sm := NewStateMachine(nil, dispatcher)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "refund"},
+	  	Action{"payment.Refund", []Any{"_event.userID", "_event.amount"}})
+	sm.Start()
+	
+	sm.SendEvent(NewDefaultEvent("refund", map[string]Any{"userID": "u1", "amount": "300"}))
+	verify(t, "TestEventDataParameter", pe.result, "u1|3|")
+}
+
+func TestEventDataParameterMissing(t *testing.T) {
+	expected := "Has no event data [_event.amount] for method [payment.Refund]."
+	defer verifyPanic(t, "TestEventDataParameterMissing", (*ActionError)(nil), expected)
+	
+	dispatcher := NewDefaultActionDispatcher()
+	dispatcher.AddActionExecutor("payment", &paymentExecutor{})
+	sm := NewStateMachine(nil, dispatcher)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "refund"},
+	  	Action{"payment.Refund", []Any{"_event.userID", "_event.amount"}})
+	sm.Start()
+	sm.SendEvent(NewDefaultEvent("refund", map[string]Any{"userID": "u1"}))
+}
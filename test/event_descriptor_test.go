@@ -0,0 +1,102 @@
+package test
+
+import (
+    "errors"
+    "testing"
+    . ".."
+)
+
+func newDescriptorStateMachine(descriptor string) *StateMachine{
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: descriptor})
+	sm.Start()
+	return sm
+}
+
+func TestEventDescriptor(t *testing.T) {
+	cases := []struct{
+		descriptor string
+		event string
+		matched bool
+	}{
+		{"error", "error", true},
+		{"error", "error.network", true},
+		{"error", "error.network.dns", true},
+		{"error", "errors", false},
+		{"error", "err", false},
+		{"error.*", "error", true},
+		{"error.*", "error.timeout", true},
+		{"error.*", "errors.timeout", false},
+		{"error.network", "error.network.dns", true},
+		{"error.network", "error.auth", false},
+		{"*", "anything", true},
+		{"e1 error.auth", "error.auth", true},
+		{"e1 error.auth", "e1", true},
+		{"e1  error.auth", "e2", false},
+	}
+	
+	for _, c := range cases {
+		sm := newDescriptorStateMachine(c.descriptor)
+		sm.SendEvent(&myEvent{c.event})
+		if sm.IsInState("s2") != c.matched {
+			t.Errorf("TestEventDescriptor: descriptor [%s] matching event [%s] should be %v",
+				c.descriptor, c.event, c.matched)
+		}
+	}
+}
+
+// exact and wildcard transitions are tried in the order of adding
+func TestEventDescriptorPrecedence(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "error.auth"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s3", EventName: "error.*"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s4", EventName: "*"})
+	
+	for event, target := range map[string]string{"error.auth": "s2", "error.network": "s3", "e1": "s4"} {
+		sm.Start()
+		sm.SendEvent(&myEvent{event})
+		verify(t, "TestEventDescriptorPrecedence " + event, sm.GetCurrentState().ID(), target)
+		sm.Stop()
+	}
+	
+	// inner state's wildcard transition is before outer state's exact one
+	sm = newOrderStateMachine(&nameDispatcher{})
+	sm.AddTransition(Transition{SourceID: "picking", TargetID: "shipping", EventName: "*"})
+	sm.Start()
+	sm.SendEvent(e1)
+	sm.SendEvent(cancel)
+	verify(t, "TestEventDescriptorPrecedence inner", sm.GetCurrentState().ID(), "shipping")
+}
+
+// "*" is only allowed as a whole token
+func TestEventDescriptorInvalid(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states)
+	for _, d := range []string{"error*", "e1 err*.network", "error.*.auth"} {
+		err := sm.AddTransitionE(Transition{SourceID: "s1", TargetID: "s2", EventName: d})
+		var ce *ConfigError
+		verify(t, "TestEventDescriptorInvalid " + d, errors.As(err, &ce), true)
+	}
+	verifyNil(t, "TestEventDescriptorInvalid valid", sm.AddTransitionE(Transition{SourceID: "s1", TargetID: "s2", EventName: "* error.*"}))
+	
+	defer verifyPanic(t, "TestEventDescriptorInvalid defer", (*ConfigError)(nil), "Invalid event descriptor [error*].")
+	sm.AddDefer("s1", "error*")
+}
+
+// config event descriptors
+func TestConfigFileEventDescriptor(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.LoadConfig(NewConfigurerXML(dir + "stateMachine_descriptor.xml"))
+	sm.Start()
+	
+	sm.SendEvent(&myEvent{"error.network"})
+	verify(t, "TestConfigFileEventDescriptor 1", sm.GetCurrentState().ID(), "s2")
+	sm.SendEvent(&myEvent{"retry"})
+	verify(t, "TestConfigFileEventDescriptor 2", sm.GetCurrentState().ID(), "s1")
+	sm.SendEvent(&myEvent{"log"})
+	verify(t, "TestConfigFileEventDescriptor 3", sm.GetCurrentState().ID(), "s3")
+}
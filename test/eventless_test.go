@@ -0,0 +1,87 @@
+package test
+
+import (
+    "testing"
+    . ".."
+)
+
+// decision state moves on by eventless transitions
+func TestEventlessTransition(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := NewStateMachine(NewDefaultConditionEvaluator(), d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", Condition: "x=1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s4", Condition: "x=0"}).
+	  AddTransition(Transition{SourceID: "s4", TargetID: "s5"}).
+	  AddTransition(Transition{SourceID: "s5", TargetID: "s1", EventName: "e2"}).
+	  AddTransition(Transition{SourceID: "s3", TargetID: "s1", EventName: "e2"}).
+	  AddOnEntry("s2", Action{"in.s2", nil}).
+	  AddOnEntry("s4", Action{"in.s4", nil})
+	sm.Start()
+	
+	// no condition satisfied, stay in decision state
+	sm.SendEvent(e1)
+	verify(t, "TestEventlessTransition 1", sm.GetCurrentState().ID(), "s2")
+	
+	// checked again after the next event
+	sm.GetContext().SetAttribute("x", 1)
+	sm.SendEvent(e3)
+	verify(t, "TestEventlessTransition 2", sm.GetCurrentState().ID(), "s3")
+	
+	sm.Stop()
+	sm.Start()
+	sm.SendEvent(e1)
+	verify(t, "TestEventlessTransition 3", sm.GetCurrentState().ID(), "s3")
+	verify(t, "TestEventlessTransition 4", sm.GetEvent().Name(), "e1")
+	
+	// repeat until stable
+	sm.SendEvent(e2)
+	sm.GetContext().SetAttribute("x", 0)
+	d.result = ""
+	sm.SendEvent(e1)
+	verify(t, "TestEventlessTransition 5", sm.GetCurrentState().ID(), "s5")
+	verify(t, "TestEventlessTransition 6", sm.GetPreviousState().ID(), "s4")
+	verify(t, "TestEventlessTransition 7", d.result, "in.s2|in.s4|")
+}
+
+// eventless transitions are checked after starting
+func TestEventlessTransitionOnStart(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2"})
+	sm.Start()
+	verify(t, "TestEventlessTransitionOnStart", sm.GetCurrentState().ID(), "s2")
+}
+
+// cycle of eventless transitions is reported
+func TestEventlessTransitionCycle(t *testing.T) {
+	expected := "Eventless transitions are taken more than 10 times, maybe there is a cycle."
+	defer verifyPanic(t, "TestEventlessTransitionCycle", (*ConfigError)(nil), expected)
+	
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetMaxEventlessSteps(10).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3"}).
+	  AddTransition(Transition{SourceID: "s3", TargetID: "s2"})
+	sm.Start()
+	sm.SendEvent(e1)
+}
+
+// config eventless transition
+func TestConfigFileEventlessTransition(t *testing.T) {
+	for _, cfg := range []Configurer{NewConfigurerXML(dir + "stateMachine_eventless.xml"),
+			NewConfigurerJSON(dir + "stateMachine_eventless.json")} {
+		sm := NewStateMachine(NewDefaultConditionEvaluator(), nil)
+		sm.LoadConfig(cfg)
+		sm.GetContext().SetAttribute("amount", 200)
+		sm.Start()
+		
+		sm.SendEvent(e1)
+		verify(t, "TestConfigFileEventlessTransition", sm.GetCurrentState().ID(), "s3")
+	}
+}
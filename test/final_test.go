@@ -0,0 +1,135 @@
+package test
+
+import (
+    "testing"
+    . ".."
+)
+
+func isClosed(c <-chan struct{}) bool{
+	select{
+		case <-c:
+			return true
+		default:
+			return false
+	}
+}
+
+var work, working, workDone, end State = &myState{"work"}, &myState{"working"}, &myState{"workDone"}, &myState{"end"}
+
+// entering a final sub state raises done event of its parent
+func TestFinalDoneEvent(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates([]State{work, s1}).
+	  AddSubStates("work", []State{working, workDone}).
+	  SetFinal("workDone").
+	  SetInitialStateID("work").
+	  AddTransition(Transition{SourceID: "working", TargetID: "workDone", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "work", TargetID: "s1", EventName: "done.state.work"}).
+	  AddOnEntry("workDone", Action{"in.workDone", nil}).
+	  AddOnEntry("s1", Action{"in.s1", nil})
+	sm.Start()
+	
+	sm.SendEvent(e1)
+	verify(t, "TestFinalDoneEvent 1", sm.GetCurrentState().ID(), "s1")
+	verify(t, "TestFinalDoneEvent 2", sm.GetPreviousState().ID(), "workDone")
+	verify(t, "TestFinalDoneEvent 3", d.result, "in.workDone|in.s1|")
+	verify(t, "TestFinalDoneEvent 4", sm.IsFinal(workDone), true)
+	verify(t, "TestFinalDoneEvent 5", sm.IsRunning(), true)
+}
+
+// the done event of parallel state is raised when all regions are in final states
+func TestFinalParallel(t *testing.T) {
+	sm := newParallelStateMachine(&nameDispatcher{})
+	sm.SetFinal("paid").SetFinal("shipped").
+	  AddTransition(Transition{SourceID: "order", TargetID: "closed", EventName: "done.state.order"})
+	sm.Start()
+	sm.SendEvent(e1)
+	
+	sm.SendEvent(pay)
+	verify(t, "TestFinalParallel 1", activeIDs(sm), "order,payment,paid,fulfilment,waiting")
+	sm.SendEvent(ship)
+	verify(t, "TestFinalParallel 2", activeIDs(sm), "closed")
+}
+
+// entering a top level final state stops the state machine
+func TestFinalTopLevel(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates([]State{s1, end}).
+	  SetFinal("end").
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "end", EventName: "e1"}).
+	  AddOnExit("end", Action{"out.end", nil})
+	sm.Start()
+	
+	done := sm.Done()
+	verify(t, "TestFinalTopLevel 1", isClosed(done), false)
+	sm.SendEvent(e1)
+	verify(t, "TestFinalTopLevel 2", isClosed(done), true)
+	verify(t, "TestFinalTopLevel 3", sm.IsRunning(), false)
+	verify(t, "TestFinalTopLevel 4", sm.IsFinished(), true)
+	verify(t, "TestFinalTopLevel 5", sm.GetPreviousState().ID(), "end")
+	verify(t, "TestFinalTopLevel 6", d.result, "out.end|")
+	verifyNil(t, "TestFinalTopLevel 7", sm.GetCurrentState())
+	
+	// a new channel after restarting
+	sm.Start()
+	verify(t, "TestFinalTopLevel 8", isClosed(sm.Done()), false)
+	verify(t, "TestFinalTopLevel 9", sm.IsFinished(), false)
+}
+
+// the channel is closed when stopping
+func TestFinalDoneOnStop(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).SetInitialStateID("s1")
+	sm.Start()
+	
+	done := sm.Done()
+	sm.Stop()
+	verify(t, "TestFinalDoneOnStop 1", isClosed(done), true)
+	verify(t, "TestFinalDoneOnStop 2", sm.IsFinished(), false)
+}
+
+// doneListener reads the done channel when the state machine stops.
+type doneListener struct{
+	DefaultListener
+	closed bool
+}
+
+func (l *doneListener) OnStopped(c *Context, status int){
+	l.closed = isClosed(c.GetStateMachine().Done())
+}
+
+// Done can be called by listeners while the state machine is stopping
+func TestFinalDoneInListener(t *testing.T) {
+	l := &doneListener{}
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).SetInitialStateID("s1").AddListener(l)
+	sm.Start()
+	sm.Stop()
+	verify(t, "TestFinalDoneInListener", l.closed, true)
+}
+
+func TestFinalSubState(t *testing.T) {
+	expected := "Final state [end] can't have sub states."
+	defer verifyPanic(t, "TestFinalSubState", (*ConfigError)(nil), expected)
+	
+	sm := NewStateMachine(nil, nil)
+	sm.AddState(end).SetFinal("end").AddSubState("end", s1)
+}
+
+// config final state
+func TestConfigFileFinal(t *testing.T) {
+	for _, cfg := range []Configurer{NewConfigurerXML(dir + "stateMachine_final.xml"),
+			NewConfigurerJSON(dir + "stateMachine_final.json")} {
+		sm := NewStateMachine(nil, nil)
+		sm.LoadConfig(cfg)
+		sm.Start()
+		
+		sm.SendEvent(e1)
+		verify(t, "TestConfigFileFinal 1", sm.GetCurrentState().ID(), "s2")
+		sm.SendEvent(e2)
+		verify(t, "TestConfigFileFinal 2", sm.IsFinished(), true)
+	}
+}
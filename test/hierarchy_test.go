@@ -0,0 +1,173 @@
+package test
+
+import (
+    "testing"
+    . ".."
+)
+
+// action dispatcher recording action names
+type nameDispatcher struct{
+	result string
+}
+
+func (d *nameDispatcher) Dispatch(a Action, c *Context){
+	d.result += a.Name + "|"
+}
+
+var processing, picking, packing, shipping, cancelled State = &myState{"processing"},
+	&myState{"picking"}, &myState{"packing"}, &myState{"shipping"}, &myState{"cancelled"}
+var pick, pack, cancel Event = &myEvent{"pick"}, &myEvent{"pack"}, &myEvent{"cancel"}
+
+// processing contains picking, packing and shipping
+func newOrderStateMachine(d ActionDispatcher) *StateMachine{
+	sm := NewStateMachine(nil, d)
+	sm.AddStates([]State{s1, processing, cancelled}).
+	  AddSubStates("processing", []State{picking, packing, shipping}).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "processing", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "packing", EventName: "e2"}).
+	  AddTransition(Transition{SourceID: "picking", TargetID: "packing", EventName: "pack"}).
+	  AddTransition(Transition{SourceID: "packing", TargetID: "shipping", EventName: "pack"}).
+	  AddTransition(Transition{SourceID: "processing", TargetID: "cancelled", EventName: "cancel"}).
+	  AddTransition(Transition{SourceID: "processing", TargetID: "picking", EventName: "pick"})
+	
+	for _, id := range []string{"s1", "processing", "picking", "packing", "shipping", "cancelled"} {
+		sm.AddOnEntry(id, Action{"in." + id, nil})
+		sm.AddOnExit(id, Action{"out." + id, nil})
+	}
+	return sm
+}
+
+// entering a compound state enters its initial sub state
+func TestSubStateInitial(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newOrderStateMachine(d)
+	sm.Start()
+	
+	d.result = ""
+	sm.SendEvent(e1)
+	verify(t, "TestSubStateInitial 1", sm.GetCurrentState().ID(), "picking")
+	verify(t, "TestSubStateInitial 2", d.result, "out.s1|in.processing|in.picking|")
+	verify(t, "TestSubStateInitial 3", sm.IsInState("processing"), true)
+	verify(t, "TestSubStateInitial 4", sm.GetParentState(sm.GetCurrentState()).ID(), "processing")
+	verify(t, "TestSubStateInitial 5", len(sm.GetSubStates(processing)), 3)
+	
+	sm.SetInitialSubStateID("processing", "shipping")
+	sm.Stop()
+	sm.Start()
+	sm.SendEvent(e1)
+	verify(t, "TestSubStateInitial 6", sm.GetCurrentState().ID(), "shipping")
+}
+
+// targeting a sub state enters its ancestors first
+func TestSubStateTarget(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newOrderStateMachine(d)
+	sm.Start()
+	
+	d.result = ""
+	sm.SendEvent(e2)
+	verify(t, "TestSubStateTarget 1", sm.GetCurrentState().ID(), "packing")
+	verify(t, "TestSubStateTarget 2", d.result, "out.s1|in.processing|in.packing|")
+}
+
+// transitions between sub states don't exit the parent state
+func TestSubStateTransition(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newOrderStateMachine(d)
+	sm.Start()
+	sm.SendEvent(e1)
+	
+	d.result = ""
+	sm.SendEvent(pack)
+	verify(t, "TestSubStateTransition 1", sm.GetCurrentState().ID(), "packing")
+	verify(t, "TestSubStateTransition 2", sm.GetPreviousState().ID(), "picking")
+	verify(t, "TestSubStateTransition 3", d.result, "out.picking|in.packing|")
+	
+	// the transition of sub state is tried first
+	d.result = ""
+	sm.SendEvent(pack)
+	verify(t, "TestSubStateTransition 4", sm.GetCurrentState().ID(), "shipping")
+	verify(t, "TestSubStateTransition 5", d.result, "out.packing|in.shipping|")
+}
+
+// transitions of parent state apply to all its sub states
+func TestInheritedTransition(t *testing.T) {
+	for _, e := range []Event{nil, pack, pack} {
+		d := &nameDispatcher{}
+		sm := newOrderStateMachine(d)
+		sm.Start()
+		sm.SendEvent(e1)
+		if e != nil {
+			sm.SendEvent(e)
+		}
+		from := sm.GetCurrentState().ID()
+		
+		d.result = ""
+		sm.SendEvent(cancel)
+		verify(t, "TestInheritedTransition 1", sm.GetCurrentState().ID(), "cancelled")
+		verify(t, "TestInheritedTransition 2", d.result, "out." + from + "|out.processing|in.cancelled|")
+		verify(t, "TestInheritedTransition 3", sm.IsInState("processing"), false)
+	}
+}
+
+// transition from parent state to its sub state exits and enters the parent state
+func TestParentToSubStateTransition(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newOrderStateMachine(d)
+	sm.Start()
+	sm.SendEvent(e1)
+	sm.SendEvent(pack)
+	
+	d.result = ""
+	sm.SendEvent(pick)
+	verify(t, "TestParentToSubStateTransition 1", sm.GetCurrentState().ID(), "picking")
+	verify(t, "TestParentToSubStateTransition 2", d.result,
+		"out.packing|out.processing|in.processing|in.picking|")
+	
+	// exit all states when stopping
+	d.result = ""
+	sm.Stop()
+	verify(t, "TestParentToSubStateTransition 3", d.result, "out.picking|out.processing|")
+}
+
+func TestSubStateNoParent(t *testing.T) {
+	expected := "Has no parent state [s9]."
+	defer verifyPanic(t, "TestSubStateNoParent", (*ConfigError)(nil), expected)
+	
+	sm := NewStateMachine(nil, nil)
+	sm.AddSubState("s9", s1)
+}
+
+func TestSubStateOfDescendant(t *testing.T) {
+	expected := "State [s1] can't be a sub state of itself or its descendant."
+	defer verifyPanic(t, "TestSubStateOfDescendant", (*ConfigError)(nil), expected)
+	
+	sm := NewStateMachine(nil, nil)
+	sm.AddState(s1).AddSubState("s1", s2)
+	sm.AddSubState("s2", s1)
+}
+
+// config nested states
+func TestConfigFileSubState(t *testing.T) {
+	file := dir + "stateMachine_subState.xml"
+	d := &nameDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.LoadConfig(NewConfigurerXML(file))
+	sm.Start()
+	
+	verify(t, "TestConfigFileSubState 1", sm.GetCurrentState().ID(), "s1")
+	sm.SendEvent(e1)
+	verify(t, "TestConfigFileSubState 2", sm.GetCurrentState().ID(), "s22")
+	verify(t, "TestConfigFileSubState 3", sm.IsInState("s2"), true)
+	
+	d.result = ""
+	sm.SendEvent(e2)
+	verify(t, "TestConfigFileSubState 4", sm.GetCurrentState().ID(), "s21")
+	verify(t, "TestConfigFileSubState 5", d.result, "a.out22|a.in21|")
+	
+	d.result = ""
+	sm.SendEvent(e3)
+	verify(t, "TestConfigFileSubState 6", sm.GetCurrentState().ID(), "s1")
+	verify(t, "TestConfigFileSubState 7", d.result, "a.out21|a.out2|")
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+    "testing"
+    . ".."
+)
+
+var running, step1, step2, step21, step22, paused State = &myState{"running"},
+	&myState{"step1"}, &myState{"step2"}, &myState{"step21"}, &myState{"step22"}, &myState{"paused"}
+var next, pause, resume, resumeDeep Event = &myEvent{"next"}, &myEvent{"pause"}, &myEvent{"resume"}, &myEvent{"resumeDeep"}
+
+// running contains step1 and step2, step2 contains step21 and step22
+func newHistoryStateMachine() *StateMachine{
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates([]State{running, paused}).
+	  AddSubStates("running", []State{step1, step2}).
+	  AddSubStates("step2", []State{step21, step22}).
+	  AddHistory("running", "hs", HISTORY_SHALLOW).
+	  AddHistory("running", "hd", HISTORY_DEEP).
+	  SetInitialStateID("running").
+	  AddTransition(Transition{SourceID: "step1", TargetID: "step2", EventName: "next"}).
+	  AddTransition(Transition{SourceID: "step21", TargetID: "step22", EventName: "next"}).
+	  AddTransition(Transition{SourceID: "running", TargetID: "paused", EventName: "pause"}).
+	  AddTransition(Transition{SourceID: "paused", TargetID: "hs", EventName: "resume"}).
+	  AddTransition(Transition{SourceID: "paused", TargetID: "hd", EventName: "resumeDeep"})
+	return sm
+}
+
+func TestShallowHistory(t *testing.T) {
+	sm := newHistoryStateMachine()
+	sm.Start()
+	sm.SendEvent(next)
+	sm.SendEvent(next)
+	verify(t, "TestShallowHistory 1", sm.GetCurrentState().ID(), "step22")
+	
+	sm.SendEvent(pause)
+	verify(t, "TestShallowHistory 2", sm.GetCurrentState().ID(), "paused")
+	sm.SendEvent(resume)
+	verify(t, "TestShallowHistory 3", sm.GetCurrentState().ID(), "step21")
+	verify(t, "TestShallowHistory 4", sm.IsInState("step2"), true)
+}
+
+func TestDeepHistory(t *testing.T) {
+	sm := newHistoryStateMachine()
+	sm.Start()
+	sm.SendEvent(next)
+	sm.SendEvent(next)
+	
+	sm.SendEvent(pause)
+	sm.SendEvent(resumeDeep)
+	verify(t, "TestDeepHistory 1", sm.GetCurrentState().ID(), "step22")
+	
+	// history is remembered every time exiting
+	sm.SendEvent(pause)
+	sm.SendEvent(resumeDeep)
+	verify(t, "TestDeepHistory 2", sm.GetCurrentState().ID(), "step22")
+}
+
+// without remembered states, enter default target or initial sub state
+func TestHistoryDefault(t *testing.T) {
+	sm := newHistoryStateMachine()
+	sm.SetInitialStateID("paused")
+	sm.Start()
+	sm.SendEvent(resumeDeep)
+	verify(t, "TestHistoryDefault 1", sm.GetCurrentState().ID(), "step1")
+	
+	sm = newHistoryStateMachine()
+	sm.SetHistoryDefault("hd", "step22").SetInitialStateID("paused")
+	sm.Start()
+	sm.SendEvent(resumeDeep)
+	verify(t, "TestHistoryDefault 2", sm.GetCurrentState().ID(), "step22")
+	
+	// remembered states are cleared when restarting
+	sm.SendEvent(pause)
+	sm.Stop()
+	sm.Start()
+	sm.SendEvent(resume)
+	verify(t, "TestHistoryDefault 3", sm.GetCurrentState().ID(), "step1")
+}
+
+// each state machine instance remembers its own history
+func TestHistoryInstance(t *testing.T) {
+	sm1 := newHistoryStateMachine()
+	sm2 := newHistoryStateMachine()
+	sm1.Start()
+	sm2.Start()
+	sm1.SendEvent(next)
+	sm1.SendEvent(pause)
+	sm2.SendEvent(pause)
+	
+	sm1.SendEvent(resume)
+	sm2.SendEvent(resume)
+	verify(t, "TestHistoryInstance 1", sm1.GetCurrentState().ID(), "step21")
+	verify(t, "TestHistoryInstance 2", sm2.GetCurrentState().ID(), "step1")
+}
+
+func TestHistoryNoParent(t *testing.T) {
+	expected := "Has no parent state [s9]."
+	defer verifyPanic(t, "TestHistoryNoParent", (*ConfigError)(nil), expected)
+	
+	sm := NewStateMachine(nil, nil)
+	sm.AddHistory("s9", "h", HISTORY_SHALLOW)
+}
+
+// config history
+func TestConfigFileHistory(t *testing.T) {
+	for _, cfg := range []Configurer{NewConfigurerXML(dir + "stateMachine_history.xml"),
+			NewConfigurerJSON(dir + "stateMachine_history.json")} {
+		sm := NewStateMachine(nil, nil)
+		sm.LoadConfig(cfg)
+		sm.Start()
+		
+		// default target
+		sm.SendEvent(e2)
+		verify(t, "TestConfigFileHistory 1", sm.GetCurrentState().ID(), "s22")
+		
+		sm.SendEvent(e3)
+		sm.SendEvent(e1)
+		verify(t, "TestConfigFileHistory 2", sm.GetCurrentState().ID(), "s21")
+		sm.SendEvent(e3)
+		sm.SendEvent(e2)
+		verify(t, "TestConfigFileHistory 3", sm.GetCurrentState().ID(), "s21")
+	}
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+    "testing"
+    "time"
+    . ".."
+)
+
+// internal transition targeting its source state only executes its actions
+func TestInternalSelfTransition(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddInternalTransition(Transition{SourceID: "s2", TargetID: "s2", EventName: "e2"}, Action{"count", nil}).
+	  AddTransition(Transition{SourceID: "s2", EventName: "e3"}, Action{"count", nil}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s2", EventName: "e4"}, Action{"count", nil}).
+	  AddOnEntry("s2", Action{"in.s2", nil}).
+	  AddOnExit("s2", Action{"out.s2", nil})
+	sm.Start()
+	sm.SendEvent(e1)
+	
+	d.result = ""
+	sm.SendEvent(e2)
+	verify(t, "TestInternalSelfTransition 1", d.result, "count|")
+	verify(t, "TestInternalSelfTransition 2", sm.GetCurrentState().ID(), "s2")
+	verify(t, "TestInternalSelfTransition 3", sm.GetPreviousState().ID(), "s1")
+	verify(t, "TestInternalSelfTransition 4", sm.GetEvent().Name(), "e2")
+	
+	// transition without target
+	d.result = ""
+	sm.SendEvent(e3)
+	verify(t, "TestInternalSelfTransition 5", d.result, "count|")
+	verify(t, "TestInternalSelfTransition 6", sm.GetPreviousState().ID(), "s1")
+	
+	// external self transition exits and enters the state
+	d.result = ""
+	sm.SendEvent(e4)
+	verify(t, "TestInternalSelfTransition 7", d.result, "out.s2|count|in.s2|")
+	verify(t, "TestInternalSelfTransition 8", sm.GetPreviousState().ID(), "s2")
+}
+
+// internal transition doesn't exit its compound source state
+func TestInternalTransitionToSubState(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newOrderStateMachine(d)
+	sm.AddInternalTransition(Transition{SourceID: "processing", TargetID: "shipping", EventName: "e3"})
+	sm.Start()
+	sm.SendEvent(e1)
+	
+	d.result = ""
+	sm.SendEvent(e3)
+	verify(t, "TestInternalTransitionToSubState 1", sm.GetCurrentState().ID(), "shipping")
+	verify(t, "TestInternalTransitionToSubState 2", d.result, "out.picking|in.shipping|")
+	
+	// external one exits and enters the source state
+	d.result = ""
+	sm.SendEvent(pick)
+	verify(t, "TestInternalTransitionToSubState 3", d.result,
+		"out.shipping|out.processing|in.processing|in.picking|")
+}
+
+// internal transition doesn't restart timeout
+func TestInternalTransitionTimeout(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  SetTimeoutEvent(timeoutEvent).
+	  AddTimeout("s1", 1).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "timeoutEvt"}).
+	  AddInternalTransition(Transition{SourceID: "s1", TargetID: "s1", EventName: "e1"})
+	
+	sm.Start()
+	clock.Advance(600 * time.Millisecond)
+	sm.SendEvent(e1)
+	clock.Advance(600 * time.Millisecond)
+	verify(t, "TestInternalTransitionTimeout", sm.GetCurrentState().ID(), "s2")
+}
+
+// internal transition doesn't change history
+func TestInternalTransitionHistory(t *testing.T) {
+	sm := newHistoryStateMachine()
+	sm.AddInternalTransition(Transition{SourceID: "running", EventName: "e1"})
+	sm.SetInitialStateID("paused")
+	sm.Start()
+	sm.SendEvent(resume)
+	sm.SendEvent(next)
+	sm.SendEvent(e1)
+	verify(t, "TestInternalTransitionHistory 1", sm.GetCurrentState().ID(), "step21")
+	
+	sm.SendEvent(pause)
+	sm.SendEvent(resumeDeep)
+	verify(t, "TestInternalTransitionHistory 2", sm.GetCurrentState().ID(), "step21")
+}
+
+// config internal transition
+func TestConfigFileInternalTransition(t *testing.T) {
+	for _, cfg := range []Configurer{NewConfigurerXML(dir + "stateMachine_internal.xml"),
+			NewConfigurerJSON(dir + "stateMachine_internal.json")} {
+		d := &nameDispatcher{}
+		sm := NewStateMachine(nil, d)
+		sm.LoadConfig(cfg)
+		sm.Start()
+		
+		d.result = ""
+		sm.SendEvent(e1)
+		verify(t, "TestConfigFileInternalTransition 1", d.result, "count|")
+		sm.SendEvent(e2)
+		verify(t, "TestConfigFileInternalTransition 2", sm.GetCurrentState().ID(), "s12")
+		verify(t, "TestConfigFileInternalTransition 3", d.result, "count|out11|")
+	}
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    . ".."
+)
+
+// journalDispatcher records the actions, and action "count" increases n.
+type journalDispatcher struct{
+	result string
+}
+
+func (d *journalDispatcher) Dispatch(a Action, c *Context){
+	d.result += a.Name + "|"
+	if a.Name == "count" {
+		n, _ := c.GetAttribute("n").(int)
+		c.SetAttribute("n", n + 1)
+	}
+}
+
+// s1 -e1-> s2 -e1-> s2, s2 goes to s3 when n>1, s3 -e3-> s4 which is final
+func newJournalMachine(d ActionDispatcher) *StateMachine {
+	sm := NewStateMachine(NewDefaultConditionEvaluator(), d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(NewManualClock(time.Now())).
+	  SetFinal("s4").
+	  AddOnEntry("s2", Action{"enter.s2", nil}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"count", nil}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s2", EventName: "e1"}, Action{"count", nil}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", Condition: "n>1"}).
+	  AddTransition(Transition{SourceID: "s3", TargetID: "s4", EventName: "e3"})
+	return sm
+}
+
+func TestJournal(t *testing.T) {
+	j := NewMemoryJournal()
+	sm := newJournalMachine(&journalDispatcher{})
+	sm.SetJournal(j)
+	sm.Start()
+	sm.SendEvent(e1)
+	sm.SendEvent(e2)
+	sm.SendEvent(NewDefaultEvent("e1", map[string]Any{"by": "u1"}))
+	sm.SendEvent(e3)
+
+	entries, _ := j.Entries()
+	verify(t, "TestJournal 1", len(entries), 4)
+	verify(t, "TestJournal 2", entries[0].Kind, JOURNAL_START)
+	verify(t, "TestJournal 3", entries[2].Seq, int64(3))
+	verify(t, "TestJournal 4", entries[2].Event, "e1")
+	verify(t, "TestJournal 5", len(entries[2].Steps), 2)
+	verify(t, "TestJournal 6", entries[2].CurrentStateID, "s3")
+	verify(t, "TestJournal 7", strings.Contains(string(entries[2].EventData), "u1"), true)
+	verify(t, "TestJournal 8", entries[3].Status, STATUS_FINISHED)
+
+	// actions are not executed when replaying
+	d := &journalDispatcher{}
+	sm2 := newJournalMachine(d)
+	verifyNil(t, "TestJournal 9", sm2.Replay(j))
+	verify(t, "TestJournal 10", d.result, "")
+	verify(t, "TestJournal 11", sm2.IsFinished(), true)
+	verify(t, "TestJournal 12", sm2.GetPreviousState().ID(), "s4")
+	verify(t, "TestJournal 13", sm2.GetContext().GetAttribute("n"), 2)
+}
+
+// a machine rebuilt by a part of journal goes on
+func TestJournalReplayRunning(t *testing.T) {
+	j := NewMemoryJournal()
+	sm := newJournalMachine(&journalDispatcher{})
+	sm.SetJournal(j)
+	sm.Start()
+	sm.SendEvent(e1)
+
+	d := &journalDispatcher{}
+	sm2 := newJournalMachine(d)
+	sm2.SetJournal(j)
+	verifyNil(t, "TestJournalReplayRunning 1", sm2.Replay(j))
+	verify(t, "TestJournalReplayRunning 2", sm2.IsRunning(), true)
+	verify(t, "TestJournalReplayRunning 3", sm2.GetCurrentState().ID(), "s2")
+
+	sm2.SendEvent(e1)
+	verify(t, "TestJournalReplayRunning 4", d.result, "count|enter.s2|")
+	verify(t, "TestJournalReplayRunning 5", sm2.GetCurrentState().ID(), "s3")
+	sm2.Stop()
+
+	entries, _ := j.Entries()
+	verify(t, "TestJournalReplayRunning 6", len(entries), 4)
+	verify(t, "TestJournalReplayRunning 7", entries[3].Seq, int64(4))
+	verify(t, "TestJournalReplayRunning 8", entries[3].Kind, JOURNAL_STOP)
+
+	sm3 := newJournalMachine(d)
+	verifyNil(t, "TestJournalReplayRunning 9", sm3.Replay(j))
+	verify(t, "TestJournalReplayRunning 10", sm3.IsRunning(), false)
+	verify(t, "TestJournalReplayRunning 11", sm3.GetPreviousState().ID(), "s3")
+}
+
+// the transitions targeting histories are replayed with the remembered states
+func TestJournalReplayHistory(t *testing.T) {
+	j := NewMemoryJournal()
+	sm := newHistoryStateMachine()
+	sm.SetJournal(j)
+	sm.Start()
+	sm.SendEvent(next)
+	sm.SendEvent(next)
+	sm.SendEvent(pause)
+	sm.SendEvent(resumeDeep)
+
+	sm2 := newHistoryStateMachine()
+	verifyNil(t, "TestJournalReplayHistory 1", sm2.Replay(j))
+	verify(t, "TestJournalReplayHistory 2", sm2.GetCurrentState().ID(), "step22")
+	sm2.SendEvent(pause)
+	sm2.SendEvent(resume)
+	verify(t, "TestJournalReplayHistory 3", sm2.GetCurrentState().ID(), "step21")
+}
+
+func TestFileJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "order1.journal")
+	sm := newJournalMachine(&journalDispatcher{})
+	sm.SetJournal(NewFileJournal(path))
+	sm.Start()
+	sm.SendEvent(e1)
+	sm.SendEvent(e1)
+
+	sm2 := newJournalMachine(&journalDispatcher{})
+	verifyNil(t, "TestFileJournal 1", sm2.Replay(NewFileJournal(path)))
+	verify(t, "TestFileJournal 2", sm2.GetCurrentState().ID(), "s3")
+
+	content, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	verify(t, "TestFileJournal 3", len(lines), 3)
+
+	// a changed entry is found by its checksum
+	os.WriteFile(path, []byte(strings.Replace(string(content), `"s3"`, `"s4"`, 1)), 0644)
+	err := newJournalMachine(&journalDispatcher{}).Replay(NewFileJournal(path))
+	var je *JournalError
+	verify(t, "TestFileJournal 4", errors.As(err, &je), true)
+	verify(t, "TestFileJournal 5", strings.HasPrefix(err.Error(), "Checksum of line [3]"), true)
+
+	// a lost entry is found by sequences
+	os.WriteFile(path, []byte(lines[0] + "\n" + lines[2] + "\n"), 0644)
+	err = newJournalMachine(&journalDispatcher{}).Replay(NewFileJournal(path))
+	verify(t, "TestFileJournal 6", err.Error(), "Journal entry [3] follows entry [1].")
+}
+
+// a torn last line left by a crash is cut off, the journal can be appended again
+func TestFileJournalTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "order1.journal")
+	sm := newJournalMachine(&journalDispatcher{})
+	sm.SetJournal(NewFileJournal(path))
+	sm.Start()
+	sm.SendEvent(e1)
+
+	content, _ := os.ReadFile(path)
+	os.WriteFile(path, append(content, `{"crc":"0123`...), 0644)
+	sm2 := newJournalMachine(&journalDispatcher{})
+	sm2.SetJournal(NewFileJournal(path))
+	verifyNil(t, "TestFileJournalTornLine 1", sm2.Replay(NewFileJournal(path)))
+	verify(t, "TestFileJournalTornLine 2", sm2.GetCurrentState().ID(), "s2")
+	unchanged, _ := os.ReadFile(path)
+	verify(t, "TestFileJournalTornLine 3", string(unchanged), string(content) + `{"crc":"0123`)
+
+	sm2.SendEvent(e1)
+	entries, err := NewFileJournal(path).Entries()
+	verifyNil(t, "TestFileJournalTornLine 4", err)
+	verify(t, "TestFileJournalTornLine 5", len(entries), 3)
+
+	// the torn line is cut off by appending without reading entries first
+	content, _ = os.ReadFile(path)
+	os.WriteFile(path, append(content, `{"crc":"0123`...), 0644)
+	verifyNil(t, "TestFileJournalTornLine 6", NewFileJournal(path).Append(entries[0]))
+	entries, err = NewFileJournal(path).Entries()
+	verifyNil(t, "TestFileJournalTornLine 7", err)
+	verify(t, "TestFileJournalTornLine 8", len(entries), 4)
+
+	// a broken line in the middle is not cut off
+	lines := strings.SplitAfter(string(content), "\n")
+	os.WriteFile(path, []byte(lines[0] + `{"crc":"0123` + "\n" + lines[1]), 0644)
+	_, err = NewFileJournal(path).Entries()
+	verify(t, "TestFileJournalTornLine 9", strings.HasPrefix(err.Error(), "Broken line [2]"), true)
+}
@@ -0,0 +1,154 @@
+package test
+
+import (
+    "fmt"
+    "testing"
+    "time"
+    . ".."
+)
+
+// recordListener records the callbacks called.
+type recordListener struct{
+	DefaultListener
+	result string
+}
+
+func (l *recordListener) OnStarted(c *Context){
+	l.result += "started|"
+}
+
+func (l *recordListener) OnStopped(c *Context, status int){
+	l.result += fmt.Sprintf("stopped:%d|", status)
+}
+
+func (l *recordListener) BeforeTransition(c *Context, event Event, t Transition){
+	l.result += "before:" + t.SourceID + "-" + t.TargetID + "|"
+}
+
+func (l *recordListener) AfterTransition(c *Context, event Event, t Transition){
+	l.result += "after:" + t.SourceID + "-" + t.TargetID + "|"
+}
+
+func (l *recordListener) OnStateEntered(c *Context, state State){
+	l.result += "entered:" + state.ID() + "|"
+}
+
+func (l *recordListener) OnStateExited(c *Context, state State){
+	l.result += "exited:" + state.ID() + "|"
+}
+
+func (l *recordListener) OnEventIgnored(c *Context, event Event, reason int){
+	l.result += fmt.Sprintf("ignored:%s:%d|", event.Name(), reason)
+}
+
+func (l *recordListener) OnGuardEvaluated(c *Context, t Transition, satisfied bool, err error){
+	l.result += fmt.Sprintf("guard:%s:%v|", t.Condition, satisfied)
+}
+
+func (l *recordListener) OnActionFailed(c *Context, a Action, err error){
+	l.result += "failed:" + a.Name + "|"
+}
+
+func (l *recordListener) OnTimeout(c *Context, state State, event Event){
+	l.result += "timeout:" + state.ID() + "|"
+}
+
+func TestListener(t *testing.T) {
+	l := &recordListener{}
+	sm := NewStateMachine(NewDefaultConditionEvaluator(), &nameDispatcher{})
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1", Condition: "x=1"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s3", EventName: "e2", Condition: "x=2"}).
+	  AddListener(l)
+	sm.GetContext().SetAttribute("x", 1)
+	sm.SendEvent(e1)
+	sm.Start()
+	verify(t, "TestListener 1", l.result, "ignored:e1:1|before:-s1|entered:s1|after:-s1|started|")
+
+	l.result = ""
+	sm.SendEvent(e3)
+	sm.SendEvent(e2)
+	verify(t, "TestListener 2", l.result, "ignored:e3:2|guard:x=2:false|ignored:e2:3|")
+
+	l.result = ""
+	sm.SendEvent(e1)
+	sm.Stop()
+	sm.Stop()
+	verify(t, "TestListener 3", l.result, "guard:x=1:true|before:s1-s2|exited:s1|entered:s2|after:s1-s2|exited:s2|stopped:0|")
+
+	l.result = ""
+	sm.RemoveListener(l)
+	sm.Start()
+	verify(t, "TestListener 4", l.result, "")
+}
+
+// raised events and the events sent with result are ignored like sent events
+func TestListenerIgnored(t *testing.T) {
+	l := &recordListener{}
+	sm := NewStateMachine(nil, &queueDispatcher{})
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"raise", []Any{"e4"}}).
+	  AddListener(l)
+	sm.Start()
+	l.result = ""
+	sm.SendEvent(e1)
+	verify(t, "TestListenerIgnored 1", l.result, "before:s1-s2|exited:s1|entered:s2|after:s1-s2|ignored:e4:2|")
+
+	sm.Stop()
+	l.result = ""
+	sm.SendEvent(e1)
+	verify(t, "TestListenerIgnored 2", l.result, "ignored:e1:1|")
+	l.result = ""
+	r := sm.SendEventWithResult(e1)
+	verify(t, "TestListenerIgnored 3", r.Status, RESULT_NOT_RUNNING)
+	verify(t, "TestListenerIgnored 4", l.result, "ignored:e1:1|")
+}
+
+func TestListenerActionFailed(t *testing.T) {
+	l := &recordListener{}
+	sm := NewStateMachine(nil, NewDefaultActionDispatcher())
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"a1.m1", nil}).
+	  AddListener(l)
+	sm.Start()
+	l.result = ""
+
+	verify(t, "TestListenerActionFailed 1", sm.TrySendEvent(e1) != nil, true)
+	verify(t, "TestListenerActionFailed 2", l.result, "before:s1-s2|exited:s1|failed:a1.m1|")
+}
+
+func TestListenerFinished(t *testing.T) {
+	l := &recordListener{}
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetFinal("s2").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddListener(l)
+	sm.Start()
+	l.result = ""
+
+	sm.SendEvent(e1)
+	verify(t, "TestListenerFinished", l.result, "before:s1-s2|exited:s1|entered:s2|after:s1-s2|exited:s2|stopped:2|")
+}
+
+func TestListenerTimeout(t *testing.T) {
+	l := &recordListener{}
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  SetTimeoutEvent(timeoutEvent).
+	  AddTimeout("s1", 1).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "timeoutEvt"}).
+	  AddListener(l)
+	sm.Start()
+	l.result = ""
+
+	clock.Advance(1200 * time.Millisecond)
+	verify(t, "TestListenerTimeout", l.result, "timeout:s1|before:s1-s2|exited:s1|entered:s2|after:s1-s2|")
+}
@@ -0,0 +1,157 @@
+package test
+
+import (
+    "testing"
+    "strings"
+    . ".."
+)
+
+func activeIDs(sm *StateMachine) string{
+	var ids []string
+	for _, s := range sm.GetActiveStates() {
+		ids = append(ids, s.ID())
+	}
+	return strings.Join(ids, ",")
+}
+
+var order, payment, unpaid, paid, fulfilment, waiting, shipped, closed State = &myState{"order"},
+	&myState{"payment"}, &myState{"unpaid"}, &myState{"paid"},
+	&myState{"fulfilment"}, &myState{"waiting"}, &myState{"shipped"}, &myState{"closed"}
+var pay, ship, close Event = &myEvent{"pay"}, &myEvent{"ship"}, &myEvent{"close"}
+
+// order is a parallel state, payment and fulfilment are its regions
+func newParallelStateMachine(d ActionDispatcher) *StateMachine{
+	sm := NewStateMachine(nil, d)
+	sm.AddStates([]State{s1, order, closed}).
+	  AddSubStates("order", []State{payment, fulfilment}).
+	  AddSubStates("payment", []State{unpaid, paid}).
+	  AddSubStates("fulfilment", []State{waiting, shipped}).
+	  SetParallel("order").
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "order", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "shipped", EventName: "e2"}).
+	  AddTransition(Transition{SourceID: "unpaid", TargetID: "paid", EventName: "pay"}).
+	  AddTransition(Transition{SourceID: "unpaid", TargetID: "paid", EventName: "e3"}).
+	  AddTransition(Transition{SourceID: "waiting", TargetID: "shipped", EventName: "ship"}).
+	  AddTransition(Transition{SourceID: "waiting", TargetID: "shipped", EventName: "e3"}).
+	  AddTransition(Transition{SourceID: "order", TargetID: "closed", EventName: "close"}).
+	  AddTransition(Transition{SourceID: "paid", TargetID: "s1", EventName: "e4"}).
+	  AddTransition(Transition{SourceID: "shipped", TargetID: "waiting", EventName: "e4"})
+	
+	for _, id := range []string{"s1", "order", "payment", "unpaid", "paid", "fulfilment", "waiting", "shipped", "closed"} {
+		sm.AddOnEntry(id, Action{"in." + id, nil})
+		sm.AddOnExit(id, Action{"out." + id, nil})
+	}
+	return sm
+}
+
+// entering a parallel state enters all its regions
+func TestParallelEntry(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newParallelStateMachine(d)
+	sm.Start()
+	
+	d.result = ""
+	sm.SendEvent(e1)
+	verify(t, "TestParallelEntry 1", activeIDs(sm), "order,payment,unpaid,fulfilment,waiting")
+	verify(t, "TestParallelEntry 2", sm.GetCurrentState().ID(), "unpaid")
+	verify(t, "TestParallelEntry 3", d.result, "out.s1|in.order|in.payment|in.unpaid|in.fulfilment|in.waiting|")
+}
+
+// targeting a state in one region enters the other regions' initial states
+func TestParallelTargetRegion(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newParallelStateMachine(d)
+	sm.Start()
+	
+	d.result = ""
+	sm.SendEvent(e2)
+	verify(t, "TestParallelTargetRegion 1", activeIDs(sm), "order,payment,unpaid,fulfilment,shipped")
+	verify(t, "TestParallelTargetRegion 2", d.result, "out.s1|in.order|in.payment|in.unpaid|in.fulfilment|in.shipped|")
+}
+
+// regions change independently
+func TestParallelRegions(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newParallelStateMachine(d)
+	sm.Start()
+	sm.SendEvent(e1)
+	
+	d.result = ""
+	sm.SendEvent(ship)
+	verify(t, "TestParallelRegions 1", activeIDs(sm), "order,payment,unpaid,fulfilment,shipped")
+	verify(t, "TestParallelRegions 2", d.result, "out.waiting|in.shipped|")
+	
+	d.result = ""
+	sm.SendEvent(pay)
+	verify(t, "TestParallelRegions 3", activeIDs(sm), "order,payment,paid,fulfilment,shipped")
+	verify(t, "TestParallelRegions 4", sm.GetCurrentState().ID(), "paid")
+	verify(t, "TestParallelRegions 5", d.result, "out.unpaid|in.paid|")
+}
+
+// one event fires transitions in every region
+func TestParallelOneEvent(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newParallelStateMachine(d)
+	sm.Start()
+	sm.SendEvent(e1)
+	
+	d.result = ""
+	sm.SendEvent(e3)
+	verify(t, "TestParallelOneEvent 1", activeIDs(sm), "order,payment,paid,fulfilment,shipped")
+	verify(t, "TestParallelOneEvent 2", d.result, "out.waiting|out.unpaid|in.paid|in.shipped|")
+}
+
+// transitions exiting same states conflict, the first one is kept
+func TestParallelConflict(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newParallelStateMachine(d)
+	sm.Start()
+	sm.SendEvent(e1)
+	sm.SendEvent(e3)
+	
+	d.result = ""
+	sm.SendEvent(e4)
+	verify(t, "TestParallelConflict 1", activeIDs(sm), "s1")
+	verify(t, "TestParallelConflict 2",  d.result,
+		"out.shipped|out.fulfilment|out.paid|out.payment|out.order|in.s1|")
+}
+
+// transition of parallel state exits all regions
+func TestParallelExit(t *testing.T) {
+	d := &nameDispatcher{}
+	sm := newParallelStateMachine(d)
+	sm.Start()
+	sm.SendEvent(e1)
+	
+	d.result = ""
+	sm.SendEvent(close)
+	verify(t, "TestParallelExit 1", activeIDs(sm), "closed")
+	verify(t, "TestParallelExit 2", d.result,
+		"out.waiting|out.fulfilment|out.unpaid|out.payment|out.order|in.closed|")
+	verify(t, "TestParallelExit 3", sm.IsInState("order"), false)
+}
+
+// config parallel state
+func TestConfigFileParallel(t *testing.T) {
+	for _, cfg := range []Configurer{NewConfigurerXML(dir + "stateMachine_parallel.xml"),
+			NewConfigurerJSON(dir + "stateMachine_parallel.json")} {
+		sm := NewStateMachine(nil, nil)
+		sm.LoadConfig(cfg)
+		sm.Start()
+		
+		verify(t, "TestConfigFileParallel 1", activeIDs(sm), "s1,s11,s12,s121")
+		sm.SendEvent(e1)
+		verify(t, "TestConfigFileParallel 2", activeIDs(sm), "s1,s11,s12,s122")
+		sm.SendEvent(e2)
+		verify(t, "TestConfigFileParallel 3", activeIDs(sm), "s2")
+	}
+}
+
+func TestConfigFileUnsupportedElement(t *testing.T) {
+	expected := "Unsupported element [datamodel]."
+	defer verifyPanic(t, "TestConfigFileUnsupportedElement", (*ConfigError)(nil), expected)
+	
+	sm := NewStateMachine(nil, nil)
+	sm.LoadConfig(NewConfigurerXML(dir + "stateMachine_unsupported.xml"))
+}
@@ -0,0 +1,312 @@
+package test
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "sync"
+    "testing"
+    "time"
+    . ".."
+)
+
+// attributeCounter increases n by action "count", it is shared by state machines.
+type attributeCounter struct{}
+
+func (d attributeCounter) Dispatch(a Action, c *Context){
+	n, _ := c.GetAttribute("n").(int)
+	c.SetAttribute("n", n + 1)
+}
+
+// s1 times out to s2 after 10 minutes, s1 -e1-> s3 -e2-> s4, e3 counts n
+func newPassivationDefinition(t *testing.T) *Definition {
+	def, err := NewDefinition(nil, attributeCounter{}, func(sm *StateMachine){
+		sm.AddStates(states).
+		  SetInitialStateID("s1").
+		  SetTimeoutEvent(timeoutEvent).
+		  AddTimeoutDuration("s1", 10 * time.Minute).
+		  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "timeoutEvt"}).
+		  AddTransition(Transition{SourceID: "s1", TargetID: "s3", EventName: "e1"}).
+		  AddTransition(Transition{SourceID: "s3", TargetID: "s4", EventName: "e2"}).
+		  AddTransition(Transition{SourceID: "s1", EventName: "e3"}, Action{"count", nil}).
+		  AddTransition(Transition{SourceID: "s3", EventName: "e3"}, Action{"count", nil})
+	})
+	if err != nil {
+		t.Fatalf("newPassivationDefinition: %v", err)
+	}
+	return def
+}
+
+func newPassivationRegistry(t *testing.T, clock Clock, store Store) *Registry {
+	return NewRegistryShards(newPassivationDefinition(t), 4).SetClock(clock).SetPassivation(store, 5 * time.Minute)
+}
+
+func TestPassivation(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := NewMemoryStore()
+	r := newPassivationRegistry(t, clock, store)
+	defer r.Close()
+
+	for _, id := range []string{"o1", "o2"} {
+		sm, err := r.Create(id)
+		verifyNil(t, "TestPassivation 1 " + id, err)
+		sm.GetContext().SetAttribute("n", 2)
+	}
+	clock.Advance(3 * time.Minute)
+	verifyNil(t, "TestPassivation 2", r.Send("o2", e1))
+
+	// o1 is idle for 5 minutes, it is evicted with 5 minutes of its timeout
+	clock.Advance(3 * time.Minute)
+	verify(t, "TestPassivation 3", fmt.Sprint(r.IDs()), "[o2]")
+	_, _, err := store.Load("o1")
+	verifyNil(t, "TestPassivation 4", err)
+	_, err = r.Create("o1")
+	verify(t, "TestPassivation 5", err, ErrMachineExists)
+
+	// o1 is loaded when its timeout is due, and o2 is evicted
+	clock.Advance(4 * time.Minute)
+	verify(t, "TestPassivation 6", fmt.Sprint(r.IDs()), "[o1]")
+	verify(t, "TestPassivation 7", r.Get("o1").GetCurrentState().ID(), "s2")
+	verify(t, "TestPassivation 8", r.Get("o1").GetContext().GetAttribute("n"), 2)
+
+	// o2 is loaded by the event sent to it
+	verifyNil(t, "TestPassivation 9", r.Send("o2", e2))
+	verify(t, "TestPassivation 10", fmt.Sprint(r.IDs()), "[o1 o2]")
+	verify(t, "TestPassivation 11", r.Get("o2").GetCurrentState().ID(), "s4")
+	verify(t, "TestPassivation 12", r.Get("o2").GetContext().GetAttribute("n"), 2)
+
+	verifyNil(t, "TestPassivation 13", r.Remove("o1"))
+	_, _, err = store.Load("o1")
+	verify(t, "TestPassivation 14", err, ErrNotFound)
+	verify(t, "TestPassivation 15", r.Send("o3", e1), ErrMachineNotFound)
+}
+
+// the state machine having scheduled events is not evicted until they are sent
+func TestPassivationScheduled(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := NewMemoryStore()
+	r := newPassivationRegistry(t, clock, store)
+	defer r.Close()
+	sm, _ := r.Create("o1")
+	sm.SendEventAfter(e1, 7 * time.Minute)
+
+	clock.Advance(5 * time.Minute)
+	verify(t, "TestPassivationScheduled 1", fmt.Sprint(r.IDs()), "[o1]")
+	_, _, err := store.Load("o1")
+	verify(t, "TestPassivationScheduled 2", err, ErrNotFound)
+
+	clock.Advance(2 * time.Minute)
+	verify(t, "TestPassivationScheduled 3", sm.GetCurrentState().ID(), "s3")
+
+	clock.Advance(3 * time.Minute)
+	verify(t, "TestPassivationScheduled 4", r.Len(), 0)
+	verify(t, "TestPassivationScheduled 5", r.Get("o1").GetCurrentState().ID(), "s3")
+}
+
+// the state machine evicted is not stopped, but refuses events
+func TestPassivationEvicted(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	r := newPassivationRegistry(t, clock, NewMemoryStore())
+	defer r.Close()
+	sm, _ := r.Create("o1")
+	clock.Advance(5 * time.Minute)
+	verify(t, "TestPassivationEvicted 1", r.Len(), 0)
+
+	verify(t, "TestPassivationEvicted 2", isClosed(sm.Done()), false)
+	verify(t, "TestPassivationEvicted 3", sm.IsRunning(), true)
+	verify(t, "TestPassivationEvicted 4", sm.TrySendEvent(e1), ErrEvicted)
+	verify(t, "TestPassivationEvicted 5", sm.TryStop(), ErrEvicted)
+	verifyNil(t, "TestPassivationEvicted 6", r.Send("o1", e1))
+	verify(t, "TestPassivationEvicted 7", sm.GetCurrentState().ID(), "s1")
+	verify(t, "TestPassivationEvicted 8", r.Get("o1").GetCurrentState().ID(), "s3")
+}
+
+// the state machines not running are not evicted, so they can be found
+func TestPassivationFinished(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := NewMemoryStore()
+	r := newOrderRegistry(t).SetClock(clock).SetPassivation(store, 5 * time.Minute)
+	defer r.Close()
+	r.Create("o1")
+	r.Create("o2")
+	r.Send("o1", e1)
+	r.Send("o1", e2)
+	clock.Advance(5 * time.Minute)
+
+	verify(t, "TestPassivationFinished 1", fmt.Sprint(r.IDs()), "[o1]")
+	ids, err := r.RemoveFinished()
+	verifyNil(t, "TestPassivationFinished 2", err)
+	verify(t, "TestPassivationFinished 3", fmt.Sprint(ids), "[o1]")
+	_, _, err = store.Load("o1")
+	verify(t, "TestPassivationFinished 4", err, ErrNotFound)
+	_, _, err = store.Load("o2")
+	verifyNil(t, "TestPassivationFinished 4", err)
+}
+
+// the timeout due while evicted fires when the state machine is loaded
+func TestPassivationElapsed(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	r := newPassivationRegistry(t, clock, NewMemoryStore())
+	r.Create("o1")
+	ids, err := r.PassivateIdle()
+	verifyNil(t, "TestPassivationElapsed 1", err)
+	verify(t, "TestPassivationElapsed 2", len(ids), 0)
+
+	clock.Advance(5 * time.Minute)
+	verify(t, "TestPassivationElapsed 3", r.Len(), 0)
+
+	// the timers are stopped, it is loaded by the next event
+	r.Close()
+	clock.Advance(time.Hour)
+	verify(t, "TestPassivationElapsed 4", r.Len(), 0)
+	verifyNil(t, "TestPassivationElapsed 5", r.Send("o1", e3))
+	clock.Advance(0)
+	verify(t, "TestPassivationElapsed 6", r.Get("o1").GetCurrentState().ID(), "s2")
+}
+
+// the snapshot without time saved by Store is loaded without elapsed time
+func TestPassivationSnapshotWithoutTime(t *testing.T) {
+	sm := newPassivationDefinition(t).NewStateMachine()
+	sm.SetClock(NewManualClock(time.Now()))
+	sm.Start()
+	data, _ := sm.Snapshot()
+	data = regexp.MustCompile(`"time":"[^"]*",`).ReplaceAll(data, nil)
+	store := NewMemoryStore()
+	store.Save("o1", data, 0)
+
+	clock := NewManualClock(time.Now().Add(24 * time.Hour))
+	r := newPassivationRegistry(t, clock, store)
+	defer r.Close()
+	verify(t, "TestPassivationSnapshotWithoutTime 1", r.Get("o1").GetCurrentState().ID(), "s1")
+	clock.Advance(0)
+	verify(t, "TestPassivationSnapshotWithoutTime 2", r.Get("o1").GetCurrentState().ID(), "s1")
+	clock.Advance(10 * time.Minute)
+	verify(t, "TestPassivationSnapshotWithoutTime 3", r.Get("o1").GetCurrentState().ID(), "s2")
+}
+
+func TestPassivationIdle(t *testing.T) {
+	defer verifyPanic(t, "TestPassivationIdle", (*ConfigError)(nil),
+		"Idle time of passivation should be greater than zero.")
+	newPassivationRegistry(t, NewManualClock(time.Now()), NewMemoryStore()).SetPassivation(NewMemoryStore(), 0)
+}
+
+// events are sent while passivating, none of them is lost, run with -race
+func TestPassivationConcurrently(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	r := newPassivationRegistry(t, clock, NewMemoryStore())
+	defer r.Close()
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("o%d", i)
+		r.Create(id)
+		r.Send(id, e1)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id string){
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := r.Send(id, e3); err != nil {
+					t.Errorf("TestPassivationConcurrently: %v", err)
+				}
+			}
+		}(fmt.Sprintf("o%d", i))
+	}
+	for i := 0; i < 20; i++ {
+		clock.Advance(time.Minute)
+		r.PassivateIdle()
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		n := r.Get(fmt.Sprintf("o%d", i)).GetContext().GetAttribute("n")
+		verify(t, "TestPassivationConcurrently " + fmt.Sprint(i), n, 20)
+	}
+}
+
+// slowStore blocks loading and deleting the snapshot of id until it is
+// released, and fails deleting with failure if it is set.
+type slowStore struct{
+	Store
+	id string
+	loading chan bool
+	release chan bool
+	failure error
+}
+
+func (s *slowStore) Load(id string) ([]byte, int64, error){
+	if id == s.id {
+		s.loading <- true
+		<-s.release
+	}
+	return s.Store.Load(id)
+}
+
+func (s *slowStore) Delete(id string, version int64) error{
+	if id == s.id {
+		s.loading <- true
+		<-s.release
+	}
+	if s.failure != nil {
+		return s.failure
+	}
+	return s.Store.Delete(id, version)
+}
+
+// loading a state machine from a slow store doesn't block the others of the shard
+func TestPassivationSlowLoad(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := &slowStore{Store: NewMemoryStore(), loading: make(chan bool), release: make(chan bool)}
+	r := NewRegistryShards(newPassivationDefinition(t), 1).SetClock(clock).SetPassivation(store, 5 * time.Minute)
+	defer r.Close()
+	r.Create("o1")
+	clock.Advance(5 * time.Minute)
+	verify(t, "TestPassivationSlowLoad 1", r.Len(), 0)
+
+	store.id = "o1"
+	got := make(chan *StateMachine)
+	go func(){
+		got <- r.Get("o1")
+	}()
+	<-store.loading
+	_, err := r.Create("o2")
+	verifyNil(t, "TestPassivationSlowLoad 2", err)
+	verifyNil(t, "TestPassivationSlowLoad 3", r.Send("o2", e1))
+	verify(t, "TestPassivationSlowLoad 4", fmt.Sprint(r.IDs()), "[o2]")
+
+	store.release <- true
+	verify(t, "TestPassivationSlowLoad 5", (<-got).GetCurrentState().ID(), "s1")
+	verify(t, "TestPassivationSlowLoad 6", fmt.Sprint(r.IDs()), "[o1 o2]")
+}
+
+// deleting a snapshot from a slow store doesn't block the others of the shard,
+// and the error of deleting is returned
+func TestPassivationSlowDelete(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	store := &slowStore{Store: NewMemoryStore(), loading: make(chan bool), release: make(chan bool)}
+	r := NewRegistryShards(newPassivationDefinition(t), 1).SetClock(clock).SetPassivation(store, 5 * time.Minute)
+	defer r.Close()
+	r.Create("o1")
+	clock.Advance(5 * time.Minute)
+	verifyNil(t, "TestPassivationSlowDelete 1", r.Send("o1", e1))
+
+	store.id = "o1"
+	removed := make(chan error)
+	go func(){
+		removed <- r.Remove("o1")
+	}()
+	<-store.loading
+	_, err := r.Create("o2")
+	verifyNil(t, "TestPassivationSlowDelete 2", err)
+	verify(t, "TestPassivationSlowDelete 3", fmt.Sprint(r.IDs()), "[o2]")
+	store.release <- true
+	verifyNil(t, "TestPassivationSlowDelete 4", <-removed)
+
+	store.id = ""
+	store.failure = errors.New("delete failed")
+	clock.Advance(5 * time.Minute)
+	verifyNil(t, "TestPassivationSlowDelete 5", r.Send("o2", e1))
+	verify(t, "TestPassivationSlowDelete 6", r.Remove("o2"), store.failure)
+	verify(t, "TestPassivationSlowDelete 7", r.Len(), 0)
+}
@@ -0,0 +1,161 @@
+package test
+
+import (
+    "sync"
+    "testing"
+    "strings"
+    . ".."
+)
+
+// queueDispatcher raises or sends the event named by action's parameter.
+type queueDispatcher struct{
+	result string
+}
+
+func (d *queueDispatcher) Dispatch(a Action, c *Context){
+	d.result += a.Name + "|"
+	switch {
+		case strings.HasPrefix(a.Name, "raise"):
+			c.Raise(NewDefaultEvent(a.Parameters[0].(string), nil))
+		case strings.HasPrefix(a.Name, "send"):
+			c.GetStateMachine().SendEvent(NewDefaultEvent(a.Parameters[0].(string), nil))
+		case a.Name == "fail":
+			panic("fail")
+	}
+}
+
+// s1 -e1-> s2 raises e2 and sends e3, s2 -e2-> s3 -e3-> s4
+func newQueueStateMachine(d ActionDispatcher) *StateMachine{
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"},
+	  	Action{"send", []Any{"e3"}}, Action{"raise", []Any{"e2"}}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"}, Action{"a2", nil}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s5", EventName: "e3"}).
+	  AddTransition(Transition{SourceID: "s3", TargetID: "s4", EventName: "e3"}, Action{"a3", nil}).
+	  AddOnEntry("s2", Action{"entry2", nil})
+	return sm
+}
+
+// raised events are processed before sent events, no deadlock when actions send events
+func TestRaiseAndSendInAction(t *testing.T) {
+	d := &queueDispatcher{}
+	sm := newQueueStateMachine(d)
+	sm.Start()
+
+	sm.SendEvent(e1)
+	verify(t, "TestRaiseAndSendInAction 1", sm.GetCurrentState().ID(), "s4")
+	verify(t, "TestRaiseAndSendInAction 2", d.result, "send|raise|entry2|a2|a3|")
+	verify(t, "TestRaiseAndSendInAction 3", sm.GetPreviousState().ID(), "s3")
+}
+
+// events raised in entry actions of initial state
+func TestRaiseInStart(t *testing.T) {
+	d := &queueDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddOnEntry("s1", Action{"raise", []Any{"e1"}}).
+	  AddOnEntry("s1", Action{"send", []Any{"e2"}}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"})
+	sm.Start()
+
+	verify(t, "TestRaiseInStart", sm.GetCurrentState().ID(), "s3")
+}
+
+// events sent after stopping in exit actions are discarded
+func TestSendInStop(t *testing.T) {
+	d := &queueDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddOnExit("s1", Action{"send", []Any{"e1"}}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"})
+	sm.Start()
+	sm.Stop()
+
+	verify(t, "TestSendInStop 1", sm.IsRunning(), false)
+	sm.Start()
+	verify(t, "TestSendInStop 2", sm.GetCurrentState().ID(), "s1")
+}
+
+// the state machine can go on processing events after an action panics
+func TestQueueAfterPanic(t *testing.T) {
+	d := &queueDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddOnEntry("s2", Action{"raise", nil}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"})
+	sm.Start()
+
+	func(){
+		defer func(){ recover() }()
+		sm.SendEvent(e1)
+	}()
+	sm.SendEvent(e2)
+	verify(t, "TestQueueAfterPanic", sm.GetCurrentState().ID(), "s3")
+}
+
+// the events raised by a failed event are discarded, the events sent are processed
+func TestQueueDrainAfterPanic(t *testing.T) {
+	d := &queueDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddOnEntry("s2", Action{"raise", []Any{"e2"}}).
+	  AddOnEntry("s2", Action{"send", []Any{"e3"}}).
+	  AddOnEntry("s2", Action{"fail", nil}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s4", EventName: "e3"})
+	sm.Start()
+
+	func(){
+		defer func(){
+			verify(t, "TestQueueDrainAfterPanic 1", recover(), "fail")
+		}()
+		sm.SendEvent(e1)
+	}()
+	verify(t, "TestQueueDrainAfterPanic 2", sm.GetCurrentState().ID(), "s4")
+	verify(t, "TestQueueDrainAfterPanic 3", sm.GetPreviousState().ID(), "s2")
+}
+
+// events sent by many goroutines are all processed
+func TestSendEventConcurrently(t *testing.T) {
+	d := &counterDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"count", nil}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s1", EventName: "e1"}, Action{"count", nil})
+	sm.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				sm.SendEvent(e1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the last sender may return before its event is processed by another one
+	sm.Stop()
+	verify(t, "TestSendEventConcurrently 1", d.count, 1000)
+	verify(t, "TestSendEventConcurrently 2", sm.GetPreviousState().ID(), "s1")
+}
+
+type counterDispatcher struct{
+	count int
+}
+
+func (d *counterDispatcher) Dispatch(a Action, c *Context){
+	d.count++
+}
@@ -0,0 +1,87 @@
+package test
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    . ".."
+)
+
+func newOrderRegistry(t *testing.T) *Registry {
+	def, err := NewDefinition(nil, nil, func(sm *StateMachine){
+		sm.AddStates(states).
+		  SetInitialStateID("s1").
+		  SetFinal("s3").
+		  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+		  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"})
+	})
+	if err != nil {
+		t.Fatalf("newOrderRegistry: %v", err)
+	}
+	return NewRegistryShards(def, 4)
+}
+
+func TestRegistry(t *testing.T) {
+	r := newOrderRegistry(t)
+	r.SetInitializer(func(id string, sm *StateMachine){
+		sm.GetContext().SetAttribute("id", id)
+	})
+	for _, id := range []string{"o3", "o1", "o2"} {
+		_, err := r.Create(id)
+		verifyNil(t, "TestRegistry 1 " + id, err)
+	}
+	_, err := r.Create("o1")
+	verify(t, "TestRegistry 2", err, ErrMachineExists)
+	verify(t, "TestRegistry 3", r.Len(), 3)
+	verify(t, "TestRegistry 4", fmt.Sprint(r.IDs()), "[o1 o2 o3]")
+	verify(t, "TestRegistry 5", r.Get("o2").GetContext().GetAttribute("id"), "o2")
+
+	verifyNil(t, "TestRegistry 6", r.Send("o1", e1))
+	verifyNil(t, "TestRegistry 7", r.Send("o2", e1))
+	verifyNil(t, "TestRegistry 8", r.Send("o2", e2))
+	verify(t, "TestRegistry 9", r.Send("o9", e1), ErrMachineNotFound)
+	verify(t, "TestRegistry 10", fmt.Sprint(r.FindInState("s1")), "[o3]")
+	verify(t, "TestRegistry 11", fmt.Sprint(r.FindInState("s2")), "[o1]")
+	verify(t, "TestRegistry 12", r.Send("o2", e1), ErrNotRunning)
+
+	ids, err := r.RemoveFinished()
+	verify(t, "TestRegistry 13", fmt.Sprint(ids, err), "[o2] <nil>")
+	verify(t, "TestRegistry 14", r.Get("o2") == nil, true)
+
+	sm := r.Get("o3")
+	verifyNil(t, "TestRegistry 15", r.Remove("o3"))
+	verify(t, "TestRegistry 16", r.Remove("o3"), ErrMachineNotFound)
+	verify(t, "TestRegistry 17", sm.IsRunning(), false)
+	verify(t, "TestRegistry 18", fmt.Sprint(r.IDs()), "[o1]")
+}
+
+// events are sent to many state machines concurrently, run with -race
+// a registry has one shard at least
+func TestRegistryShards(t *testing.T) {
+	def, _ := NewDefinition(nil, nil, func(sm *StateMachine){
+		sm.AddStates(states).SetInitialStateID("s1")
+	})
+	r := NewRegistryShards(def, 0)
+	_, err := r.Create("o1")
+	verifyNil(t, "TestRegistryShards 1", err)
+	verify(t, "TestRegistryShards 2", r.Get("o1").GetCurrentState().ID(), "s1")
+}
+
+func TestRegistryConcurrently(t *testing.T) {
+	r := newOrderRegistry(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id string){
+			defer wg.Done()
+			r.Create(id)
+			r.Send(id, e1)
+			r.Send(id, e2)
+			r.FindInState("s2")
+		}(fmt.Sprintf("o%d", i))
+	}
+	wg.Wait()
+	ids, _ := r.RemoveFinished()
+	verify(t, "TestRegistryConcurrently 1", len(ids), 50)
+	verify(t, "TestRegistryConcurrently 2", r.Len(), 0)
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+    "errors"
+    "testing"
+    . ".."
+)
+
+func newResultStateMachine() (*StateMachine, *nameDispatcher){
+	d := &nameDispatcher{}
+	sm := NewStateMachine(NewDefaultConditionEvaluator(), d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddOnExit("s1", Action{"exit1", nil}).
+	  AddOnEntry("s2", Action{"entry2", nil}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s3", EventName: "e1", Condition: "x=1"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1", Condition: "x=2"}, Action{"t12", nil}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s4", EventName: "e2", Condition: "x=3"}).
+	  AddTransition(Transition{SourceID: "s2", EventName: "e3"}, Action{"t2", nil}).
+	  AddDefer("s1", "e4")
+	sm.GetContext().SetAttribute("x", 2)
+	return sm, d
+}
+
+func TestEventResultTransited(t *testing.T) {
+	sm, _ := newResultStateMachine()
+	sm.Start()
+
+	r := sm.SendEventWithResult(e1)
+	verify(t, "TestEventResultTransited 1", r.Status, RESULT_TRANSITED)
+	verify(t, "TestEventResultTransited 2", r.Event, e1)
+	verify(t, "TestEventResultTransited 3", len(r.Transitions), 1)
+	verify(t, "TestEventResultTransited 4", r.Transitions[0].Transition.Condition, "x=2")
+	verify(t, "TestEventResultTransited 5", r.Transitions[0].Source, s1)
+	verify(t, "TestEventResultTransited 6", r.Transitions[0].Target, s2)
+	verify(t, "TestEventResultTransited 7", len(r.Guards), 2)
+	verify(t, "TestEventResultTransited 8", r.Guards[0].Satisfied, false)
+	verify(t, "TestEventResultTransited 9", r.Guards[1].Satisfied, true)
+	verify(t, "TestEventResultTransited 10", len(r.Actions), 3)
+	verify(t, "TestEventResultTransited 11", r.Actions[0].Action.Name + r.Actions[1].Action.Name + r.Actions[2].Action.Name, "exit1t12entry2")
+	verifyNil(t, "TestEventResultTransited 12", r.Err)
+
+	// targetless transition
+	r = sm.SendEventWithResult(e3)
+	verify(t, "TestEventResultTransited 13", r.Status, RESULT_TRANSITED)
+	verifyNil(t, "TestEventResultTransited 14", r.Transitions[0].Target)
+	verify(t, "TestEventResultTransited 15", len(r.Actions), 1)
+}
+
+func TestEventResultIgnored(t *testing.T) {
+	sm, _ := newResultStateMachine()
+	verify(t, "TestEventResultIgnored 1", sm.SendEventWithResult(e1).Status, RESULT_NOT_RUNNING)
+	sm.Start()
+
+	verify(t, "TestEventResultIgnored 2", sm.SendEventWithResult(e5).Status, RESULT_NO_TRANSITION)
+	r := sm.SendEventWithResult(e2)
+	verify(t, "TestEventResultIgnored 3", r.Status, RESULT_GUARDS_FALSE)
+	verify(t, "TestEventResultIgnored 4", len(r.Guards), 1)
+	verify(t, "TestEventResultIgnored 5", r.Guards[0].Transition.TargetID, "s4")
+	verify(t, "TestEventResultIgnored 6", sm.SendEventWithResult(e4).Status, RESULT_DEFERRED)
+	verify(t, "TestEventResultIgnored 7", sm.GetCurrentState().ID(), "s1")
+}
+
+func TestEventResultFailed(t *testing.T) {
+	sm, _ := newResultStateMachine()
+	sm.GetContext().SetAttribute("x", true)
+	sm.AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e5", Condition: "x>1"})
+	sm.Start()
+
+	// operator ">" is not supported for bool
+	r := sm.SendEventWithResult(e5)
+	var ce *ConditionError
+	verify(t, "TestEventResultFailed 1", r.Status, RESULT_FAILED)
+	verify(t, "TestEventResultFailed 2", errors.As(r.Err, &ce), true)
+	verify(t, "TestEventResultFailed 3", len(r.Guards), 1)
+	verify(t, "TestEventResultFailed 4", r.Guards[0].Err, r.Err)
+
+	// action fails
+	dispatcher := NewDefaultActionDispatcher()
+	sm = NewStateMachine(nil, dispatcher)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"a1.m1", nil})
+	sm.Start()
+	r = sm.SendEventWithResult(e1)
+	var ae *ActionError
+	verify(t, "TestEventResultFailed 5", r.Status, RESULT_FAILED)
+	verify(t, "TestEventResultFailed 6", errors.As(r.Err, &ae), true)
+	verify(t, "TestEventResultFailed 7", len(r.Actions), 1)
+	verify(t, "TestEventResultFailed 8", r.Actions[0].Err, r.Err)
+}
+
+// the failure of an event sent by the action is not the result's
+func TestEventResultQueuedFailed(t *testing.T) {
+	l := &failedListener{failed: make(chan string, 1)}
+	sm := NewStateMachine(nil, &queueDispatcher{})
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}, Action{"send", []Any{"e2"}}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"}, Action{"fail", nil}).
+	  AddListener(l)
+	sm.Start()
+
+	r := sm.SendEventWithResult(e1)
+	verify(t, "TestEventResultQueuedFailed 1", r.Status, RESULT_TRANSITED)
+	verifyNil(t, "TestEventResultQueuedFailed 2", r.Err)
+	verify(t, "TestEventResultQueuedFailed 3", <-l.failed, "e2:panic: fail")
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+    "strings"
+    "testing"
+    "time"
+    . ".."
+)
+
+// scheduleDispatcher schedules the event named by action's parameter.
+type scheduleDispatcher struct{
+	ids []string
+}
+
+func (d *scheduleDispatcher) Dispatch(a Action, c *Context){
+	sm := c.GetStateMachine()
+	switch a.Name {
+		case "schedule":
+			d.ids = append(d.ids, sm.SendEventAfter(NewDefaultEvent(a.Parameters[0].(string), nil), 5 * time.Second))
+		case "cancel":
+			for _, id := range d.ids {
+				sm.CancelScheduled(id)
+			}
+	}
+}
+
+func TestSendEventAfter(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"})
+	sm.Start()
+
+	id1 := sm.SendEventAfter(e1, time.Second)
+	id2 := sm.SendEventAfter(e2, 2 * time.Second)
+	verify(t, "TestSendEventAfter 1", strings.HasPrefix(id1, SCHEDULED_ID_PREFIX), true)
+	verify(t, "TestSendEventAfter 2", id1 != id2, true)
+
+	clock.Advance(999 * time.Millisecond)
+	verify(t, "TestSendEventAfter 3", sm.GetCurrentState().ID(), "s1")
+	clock.Advance(time.Millisecond)
+	verify(t, "TestSendEventAfter 4", sm.GetCurrentState().ID(), "s2")
+	verify(t, "TestSendEventAfter 5", sm.CancelScheduled(id1), false)
+
+	verify(t, "TestSendEventAfter 6", sm.CancelScheduled(id2), true)
+	verify(t, "TestSendEventAfter 7", sm.CancelScheduled(id2), false)
+	clock.Advance(time.Second)
+	verify(t, "TestSendEventAfter 8", sm.GetCurrentState().ID(), "s2")
+}
+
+// actions schedule and cancel events
+func TestSendEventAfterInAction(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	d := &scheduleDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  AddOnEntry("s2", Action{"schedule", []Any{"retry"}}).
+	  AddOnExit("s2", Action{"cancel", nil}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s1", EventName: "retry"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "e2"})
+	sm.Start()
+
+	sm.SendEvent(e1)
+	clock.Advance(5 * time.Second)
+	verify(t, "TestSendEventAfterInAction 1", sm.GetCurrentState().ID(), "s1")
+
+	// the retry is cancelled when exiting s2
+	sm.SendEvent(e1)
+	sm.SendEvent(e2)
+	verify(t, "TestSendEventAfterInAction 2", clock.PendingTimers(), 0)
+	verify(t, "TestSendEventAfterInAction 3", sm.GetCurrentState().ID(), "s3")
+}
+
+// scheduled events are cancelled when stopping, and ignored if not running
+func TestSendEventAfterStop(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"})
+	sm.Start()
+	sm.SendEventAfter(e1, time.Second)
+	sm.Stop()
+	verify(t, "TestSendEventAfterStop 1", clock.PendingTimers(), 0)
+
+	sm.SendEventAfter(e1, time.Second)
+	clock.Advance(time.Second)
+	sm.Start()
+	verify(t, "TestSendEventAfterStop 2", sm.GetCurrentState().ID(), "s1")
+}
+
+func TestSendEventAfterRealClock(t *testing.T) {
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetFinal("s2").
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"})
+	sm.Start()
+	sm.SendEventAfter(e1, 10 * time.Millisecond)
+
+	select{
+		case <-sm.Done():
+		case <-time.After(time.Second):
+			t.Errorf("TestSendEventAfterRealClock: the scheduled event is not sent")
+	}
+	verify(t, "TestSendEventAfterRealClock", sm.IsFinished(), true)
+}
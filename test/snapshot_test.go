@@ -0,0 +1,187 @@
+package test
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+    . ".."
+)
+
+type address struct{
+	City string
+	Zip string
+}
+
+// newSnapshotMachine creates the machine of order: s1 contains s3 and s4, s1 has
+// a repeating reminder and s4 has a timeout.
+func newSnapshotMachine(clock Clock, d ActionDispatcher) *StateMachine {
+	sm := NewStateMachine(NewDefaultConditionEvaluator(), d)
+	sm.AddStates([]State{s1, s2}).
+	  AddSubStates("s1", []State{s3, s4}).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  SetTimeoutEvent(timeoutEvent).
+	  AddTimeoutDuration("s4", 10 * time.Minute).
+	  AddStateTimer("s1", StateTimer{"reminder", time.Hour, remind, true}).
+	  AddOnEntry("s1", Action{"enter.s1", nil}).
+	  AddOnEntry("s4", Action{"enter.s4", nil}).
+	  AddTransition(Transition{SourceID: "s3", TargetID: "s4", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s4", TargetID: "s2", EventName: "timeoutEvt"}, Action{"timeout", nil}).
+	  AddTransition(Transition{SourceID: "s1", EventName: "remind"}, Action{"remind", nil}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s1", EventName: "e2", Condition: "n>1"})
+	return sm
+}
+
+func TestSnapshot(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := newSnapshotMachine(clock, &nameDispatcher{})
+	sm.GetContext().SetAttribute("n", 2)
+	sm.GetContext().SetAttribute("ratio", 0.5)
+	sm.GetContext().SetAttribute("name", "order")
+	sm.GetContext().SetAttribute("none", nil)
+	sm.Start()
+	clock.Advance(55 * time.Minute)
+	sm.SendEvent(e1)
+	clock.Advance(4 * time.Minute)
+	data, err := sm.Snapshot()
+	verifyNil(t, "TestSnapshot 1", err)
+	sm.Stop()
+
+	// restored in another process later
+	clock2 := NewManualClock(time.Now().Add(24 * time.Hour))
+	d := &nameDispatcher{}
+	sm2 := newSnapshotMachine(clock2, d)
+	verifyNil(t, "TestSnapshot 2", sm2.Restore(data))
+	verify(t, "TestSnapshot 3", d.result, "")
+	verify(t, "TestSnapshot 4", sm2.IsRunning(), true)
+	verify(t, "TestSnapshot 5", sm2.GetCurrentState().ID(), "s4")
+	verify(t, "TestSnapshot 6", sm2.GetPreviousState().ID(), "s3")
+	verify(t, "TestSnapshot 7", sm2.IsInState("s1"), true)
+	verify(t, "TestSnapshot 8", sm2.GetContext().GetAttribute("n"), 2)
+	verify(t, "TestSnapshot 9", sm2.GetContext().GetAttribute("ratio"), 0.5)
+	verify(t, "TestSnapshot 10", sm2.GetContext().GetAttribute("name"), "order")
+	_, ok := sm2.GetContext().GetAttributes()["none"]
+	verify(t, "TestSnapshot 11", ok, true)
+	verify(t, "TestSnapshot 12", clock2.PendingTimers(), 2)
+
+	// the reminder has 1 minute left, and the timeout has 6 minutes left
+	clock2.Advance(59 * time.Second)
+	verify(t, "TestSnapshot 13", d.result, "")
+	clock2.Advance(time.Second)
+	verify(t, "TestSnapshot 14", d.result, "remind|")
+	clock2.Advance(5 * time.Minute)
+	verify(t, "TestSnapshot 15", d.result, "remind|timeout|")
+	verify(t, "TestSnapshot 16", sm2.GetCurrentState().ID(), "s2")
+
+	// conditions use the restored attributes
+	sm2.SendEvent(e2)
+	verify(t, "TestSnapshot 17", sm2.GetCurrentState().ID(), "s3")
+}
+
+// Start goes to the initial state, not the restored state
+func TestSnapshotStart(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := newSnapshotMachine(clock, &nameDispatcher{})
+	sm.Start()
+	sm.SendEvent(e1)
+	data, _ := sm.Snapshot()
+
+	d := &nameDispatcher{}
+	sm2 := newSnapshotMachine(clock, d)
+	sm2.Restore(data)
+	sm2.Stop()
+	d.result = ""
+	sm2.Start()
+	verify(t, "TestSnapshotStart 1", sm2.GetCurrentState().ID(), "s3")
+	verify(t, "TestSnapshotStart 2", d.result, "enter.s1|")
+}
+
+func TestSnapshotStopped(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := newSnapshotMachine(clock, &nameDispatcher{})
+	sm.Start()
+	sm.Stop()
+	data, _ := sm.Snapshot()
+
+	sm2 := newSnapshotMachine(clock, &nameDispatcher{})
+	sm2.Start()
+	verifyNil(t, "TestSnapshotStopped 1", sm2.Restore(data))
+	verify(t, "TestSnapshotStopped 2", sm2.IsRunning(), false)
+	verify(t, "TestSnapshotStopped 3", sm2.GetCurrentState() == nil, true)
+	verify(t, "TestSnapshotStopped 4", clock.PendingTimers(), 0)
+	select{
+		case <-sm2.Done():
+		default:
+			t.Errorf("TestSnapshotStopped 5: Done is not closed")
+	}
+}
+
+func TestSnapshotCodec(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := newSnapshotMachine(clock, &nameDispatcher{})
+	sm.GetContext().SetAttribute("address", address{"Paris", "75001"})
+	_, err := sm.Snapshot()
+	var se *SnapshotError
+	verify(t, "TestSnapshotCodec 1", errors.As(err, &se), true)
+
+	sm.SetAttributeCodec(NewJSONAttributeCodec().Register("address", address{}))
+	data, err := sm.Snapshot()
+	verifyNil(t, "TestSnapshotCodec 2", err)
+
+	sm2 := newSnapshotMachine(clock, &nameDispatcher{})
+	verify(t, "TestSnapshotCodec 3", sm2.Restore(data) != nil, true)
+	sm2.SetAttributeCodec(NewJSONAttributeCodec().Register("address", address{}))
+	verifyNil(t, "TestSnapshotCodec 4", sm2.Restore(data))
+	verify(t, "TestSnapshotCodec 5", sm2.GetContext().GetAttribute("address"), address{"Paris", "75001"})
+
+	sm.GetContext().SetAttribute(1, "key")
+	_, err = sm.Snapshot()
+	verify(t, "TestSnapshotCodec 6", err != nil, true)
+}
+
+// the remembered states of histories are restored
+func TestSnapshotHistory(t *testing.T) {
+	sm := newHistoryStateMachine()
+	sm.Start()
+	sm.SendEvent(next)
+	sm.SendEvent(next)
+	sm.SendEvent(pause)
+	data, err := sm.Snapshot()
+	verifyNil(t, "TestSnapshotHistory 1", err)
+
+	sm2 := newHistoryStateMachine()
+	verifyNil(t, "TestSnapshotHistory 2", sm2.Restore(data))
+	verify(t, "TestSnapshotHistory 3", sm2.GetCurrentState().ID(), "paused")
+	sm2.SendEvent(resumeDeep)
+	verify(t, "TestSnapshotHistory 4", sm2.GetCurrentState().ID(), "step22")
+
+	// the histories should be configured
+	sm3 := NewStateMachine(nil, nil)
+	sm3.AddStates([]State{running, paused}).
+	  AddSubStates("running", []State{step1, step2}).
+	  AddSubStates("step2", []State{step21, step22}).
+	  SetInitialStateID("running")
+	err = sm3.Restore(data)
+	verify(t, "TestSnapshotHistory 5", strings.HasPrefix(err.Error(), "Has no history [h"), true)
+}
+
+// an invalid snapshot doesn't change state machine
+func TestSnapshotError(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := newSnapshotMachine(clock, &nameDispatcher{})
+	sm.Start()
+	data, _ := sm.Snapshot()
+
+	sm2 := NewStateMachine(nil, nil)
+	sm2.AddStates([]State{s1, s3}).SetInitialStateID("s3")
+	sm2.Start()
+	err := sm2.Restore(data)
+	verify(t, "TestSnapshotError 1", err.Error(), "Has no timer [reminder] of state [s1].")
+	verify(t, "TestSnapshotError 2", sm2.GetCurrentState().ID(), "s3")
+
+	err = sm2.Restore([]byte(strings.Replace(string(data), `"version":1`, `"version":9`, 1)))
+	verify(t, "TestSnapshotError 3", err.Error(), "Unsupported snapshot version [9].")
+	err = sm2.Restore([]byte("{"))
+	verify(t, "TestSnapshotError 4", err != nil, true)
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    . ".."
+)
+
+func verifyStore(t *testing.T, name string, store Store) {
+	_, _, err := store.Load("order/1")
+	verify(t, name + " 1", err, ErrNotFound)
+
+	v, err := store.Save("order/1", []byte("a"), 0)
+	verifyNil(t, name + " 2", err)
+	verify(t, name + " 3", v, int64(1))
+	_, err = store.Save("order/1", []byte("b"), 0)
+	verify(t, name + " 4", err, ErrVersionConflict)
+	v, err = store.Save("order/1", []byte("b"), 1)
+	verify(t, name + " 5", v, int64(2))
+
+	data, v, err := store.Load("order/1")
+	verifyNil(t, name + " 6", err)
+	verify(t, name + " 7", string(data), "b")
+	verify(t, name + " 8", v, int64(2))
+
+	verify(t, name + " 9", store.Delete("order/1", 1), ErrVersionConflict)
+	verifyNil(t, name + " 10", store.Delete("order/1", 2))
+	verify(t, name + " 11", store.Delete("order/1", 2), ErrNotFound)
+	v, err = store.Save("order/1", []byte("c"), 0)
+	verify(t, name + " 12", v, int64(1))
+}
+
+func TestMemoryStore(t *testing.T) {
+	verifyStore(t, "TestMemoryStore", NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	verifyStore(t, "TestFileStore", NewFileStore(dir))
+
+	// the id is escaped, and no temporary file is left
+	files, _ := os.ReadDir(dir)
+	verify(t, "TestFileStore 13", len(files), 1)
+	verify(t, "TestFileStore 14", files[0].Name(), "order%2F1.snapshot")
+
+	os.WriteFile(filepath.Join(dir, "bad.snapshot"), []byte("x"), 0644)
+	_, _, err := NewFileStore(dir).Load("bad")
+	var se *StoreError
+	verify(t, "TestFileStore 15", errors.As(err, &se), true)
+}
+
+func TestStoreStateMachine(t *testing.T) {
+	store := NewMemoryStore()
+	sm := newSnapshotMachine(NewManualClock(time.Now()), &nameDispatcher{})
+	sm.SetStore(store, "order1")
+	sm.Start()
+	_, v, _ := store.Load("order1")
+	verify(t, "TestStoreStateMachine 1", v, int64(1))
+
+	// only transitions are saved
+	sm.SendEvent(e1)
+	sm.SendEvent(e3)
+	_, v, _ = store.Load("order1")
+	verify(t, "TestStoreStateMachine 2", v, int64(2))
+
+	// another process takes over the order after a crash
+	clock := NewManualClock(time.Now())
+	d := &nameDispatcher{}
+	sm2 := newSnapshotMachine(clock, d)
+	sm2.SetStore(store, "order1")
+	verifyNil(t, "TestStoreStateMachine 3", sm2.RestoreFromStore())
+	verify(t, "TestStoreStateMachine 4", sm2.GetCurrentState().ID(), "s4")
+	verify(t, "TestStoreStateMachine 5", d.result, "")
+
+	clock.Advance(10 * time.Minute)
+	verify(t, "TestStoreStateMachine 6", sm2.GetCurrentState().ID(), "s2")
+	data, v, _ := store.Load("order1")
+	verify(t, "TestStoreStateMachine 7", v, int64(3))
+	sm3 := newSnapshotMachine(clock, d)
+	sm3.Restore(data)
+	verify(t, "TestStoreStateMachine 8", sm3.GetCurrentState().ID(), "s2")
+
+	// the old one can't overwrite it
+	verify(t, "TestStoreStateMachine 9", sm.TryStop(), ErrVersionConflict)
+
+	sm2.Stop()
+	_, v, _ = store.Load("order1")
+	verify(t, "TestStoreStateMachine 10", v, int64(4))
+}
+
+func TestStoreStateMachineError(t *testing.T) {
+	store := NewMemoryStore()
+	store.Save("order1", []byte("{}"), 0)
+	sm := newSnapshotMachine(NewManualClock(time.Now()), &nameDispatcher{})
+	sm.SetStore(store, "order1")
+	verify(t, "TestStoreStateMachineError 1", sm.TryStart(), ErrVersionConflict)
+
+	sm.SetStore(store, "order2")
+	verify(t, "TestStoreStateMachineError 2", sm.RestoreFromStore(), ErrNotFound)
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+    "errors"
     "testing"
     "time"
     
@@ -23,9 +24,11 @@ func TestTimeout(t *testing.T) {
 
 // test canceling timeout event. happend some other events before timeout
 func TestTimeoutCancel(t *testing.T) {
+	clock := NewManualClock(time.Now())
 	sm := NewStateMachine(nil, nil)
 	sm.AddStates(states).
 	  SetInitialStateID("s1").
+	  SetClock(clock).
 	  SetTimeoutEvent(timeoutEvent).
 	  AddTimeout("s1", 1).
 	  AddTransition(Transition{"s1", "s2", "timeoutEvt", ""}).
@@ -34,16 +37,18 @@ func TestTimeoutCancel(t *testing.T) {
 	sm.Start()
 	// e1 changed state machine's state
 	sm.SendEvent(e1);
-	time.Sleep(1200 * time.Millisecond)
+	clock.Advance(1200 * time.Millisecond)
 	verify(t, "TestTimeoutCancel", sm.GetCurrentState().ID(), "s3")
 }	
 
 // test not canceling timeout event. 
 // happend some other events before timeout, but dose not change state
 func TestTimeoutNotCancel(t *testing.T) {
+	clock := NewManualClock(time.Now())
 	sm := NewStateMachine(nil, nil)
 	sm.AddStates(states).
 	  SetInitialStateID("s1").
+	  SetClock(clock).
 	  SetTimeoutEvent(timeoutEvent).
 	  AddTimeout("s1", 1).
 	  AddTransition(Transition{"s1", "s2", "timeoutEvt", ""}).
@@ -52,29 +57,33 @@ func TestTimeoutNotCancel(t *testing.T) {
 	sm.Start()
 	// e2 dose not changed state machine's state
 	sm.SendEvent(e2)
-	time.Sleep(1200 * time.Millisecond)
+	clock.Advance(1200 * time.Millisecond)
 	verify(t, "TestTimeoutNotCancel", sm.GetCurrentState().ID(), "s2")
 }	
 
 // test default timeout state
 func TestDefaultTimeoutState(t *testing.T) {
+	clock := NewManualClock(time.Now())
 	sm := NewStateMachine(nil, nil)
 	sm.AddStates(states).
 	  SetInitialStateID("s1").
+	  SetClock(clock).
 	  SetTimeoutEvent(timeoutEvent).
 	  AddTimeout("s1", 1).
 	  SetDefaultTimeoutStateID("s3")
 	
 	sm.Start()
-	time.Sleep(1200 * time.Millisecond)
+	clock.Advance(1200 * time.Millisecond)
 	verify(t, "TestDefaultTimeoutState", sm.GetCurrentState().ID(), "s3")
 }	
 
 // test if the state machine is normal or not after receiving timeout event
 func TestTimeoutStateNormal(t *testing.T) {
+	clock := NewManualClock(time.Now())
 	sm := NewStateMachine(nil, nil)
 	sm.AddStates(states).
 	  SetInitialStateID("s1").
+	  SetClock(clock).
 	  SetTimeoutEvent(timeoutEvent).
 	  AddTimeout("s1", 1).
 	  SetDefaultTimeoutStateID("s3").
@@ -82,11 +91,62 @@ func TestTimeoutStateNormal(t *testing.T) {
 	
 	sm.Start()
 	// atfer timeout, the state should be s3
-	time.Sleep(1200 * time.Millisecond)
+	clock.Advance(1200 * time.Millisecond)
 	verify(t, "TestTimeoutStateNormal 1", sm.GetCurrentState().ID(), "s3")
 	
 	// after e1, the state should be s2
 	sm.SendEvent(e1)
-	time.Sleep(1200 * time.Millisecond)
+	clock.Advance(1200 * time.Millisecond)
 	verify(t, "TestTimeoutStateNormal", sm.GetCurrentState().ID(), "s2")
 }	
+
+// test sub-second timeout
+func TestTimeoutDuration(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  SetTimeoutEvent(timeoutEvent).
+	  AddTimeoutDuration("s1", 200 * time.Millisecond).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "timeoutEvt"})
+	verify(t, "TestTimeoutDuration 1", sm.GetTimeoutDuration(s1), 200 * time.Millisecond)
+	verify(t, "TestTimeoutDuration 2", sm.GetTimeout(s1), 0)
+	
+	sm.Start()
+	clock.Advance(199 * time.Millisecond)
+	verify(t, "TestTimeoutDuration 3", sm.GetCurrentState().ID(), "s1")
+	clock.Advance(time.Millisecond)
+	verify(t, "TestTimeoutDuration 4", sm.GetCurrentState().ID(), "s2")
+}
+
+func verifyTimeoutConfig(t *testing.T, name string, cfg Configurer) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.SetClock(clock).SetTimeoutEvent(timeoutEvent)
+	sm.LoadConfig(cfg)
+	verify(t, name + " 1", sm.GetTimeoutDuration(&myState{"s1"}), 500 * time.Millisecond)
+	verify(t, name + " 2", sm.GetTimeoutDuration(&myState{"s2"}), 250 * time.Millisecond)
+	verify(t, name + " 3", sm.GetTimeoutDuration(&myState{"s3"}), 90 * time.Second)
+	verify(t, name + " 4", sm.GetTimeout(&myState{"s4"}), 2)
+	
+	sm.Start()
+	clock.Advance(500 * time.Millisecond)
+	verify(t, name + " 5", sm.GetCurrentState().ID(), "s2")
+	clock.Advance(250 * time.Millisecond)
+	verify(t, name + " 6", sm.GetCurrentState().ID(), "s3")
+}
+
+func TestConfigFileTimeoutXML(t *testing.T) {
+	verifyTimeoutConfig(t, "TestConfigFileTimeoutXML", NewConfigurerXML(dir + "stateMachine_timeout.xml"))
+}
+
+func TestConfigFileTimeoutJSON(t *testing.T) {
+	verifyTimeoutConfig(t, "TestConfigFileTimeoutJSON", NewConfigurerJSON(dir + "stateMachine_timeout.json"))
+}
+
+func TestConfigFileTimeoutError(t *testing.T) {
+	_, err := NewConfigurerXMLE(dir + "stateMachine_timeoutError.xml")
+	var pe *ParseError
+	verify(t, "TestConfigFileTimeoutError", errors.As(err, &pe), true)
+}
@@ -0,0 +1,112 @@
+package test
+
+import (
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    . ".."
+)
+
+// advanceEvaluator advances the clock when evaluating conditions, so that
+// timers fire while the state machine is processing an event.
+type advanceEvaluator struct{
+	clock *ManualClock
+}
+
+func (e *advanceEvaluator) IsSatisfied(condition string, context *Context) bool{
+	e.clock.Advance(time.Second)
+	return true
+}
+
+// the timeout fired while processing an event that exits the state is discarded
+func TestStaleTimeoutDiscarded(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(&advanceEvaluator{clock}, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  SetTimeoutEvent(timeoutEvent).
+	  AddTimeout("s1", 1).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1", Condition: "advance"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s3", EventName: "timeoutEvt"})
+	sm.Start()
+
+	sm.SendEvent(e1)
+	verify(t, "TestStaleTimeoutDiscarded", sm.GetCurrentState().ID(), "s2")
+}
+
+// the timer fired before re-entering a state is discarded, the new one counts
+// time from re-entering
+func TestStaleTimerReentry(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	l := &recordListener{}
+	sm := NewStateMachine(&advanceEvaluator{clock}, nil)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  AddStateTimer("s1", StateTimer{"t1", time.Second, e2, false}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s1", EventName: "e1", Condition: "advance"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e2"}).
+	  AddListener(l)
+	sm.Start()
+	l.result = ""
+
+	sm.SendEvent(e1)
+	verify(t, "TestStaleTimerReentry 1", sm.GetCurrentState().ID(), "s1")
+	verify(t, "TestStaleTimerReentry 2", clock.PendingTimers(), 1)
+
+	clock.Advance(time.Second)
+	verify(t, "TestStaleTimerReentry 3", sm.GetCurrentState().ID(), "s2")
+	verify(t, "TestStaleTimerReentry 4", l.result,
+		"guard:advance:true|before:s1-s1|exited:s1|entered:s1|after:s1-s1|timeout:s1|before:s1-s2|exited:s1|entered:s2|after:s1-s2|")
+}
+
+// countDispatcher counts actions safely across goroutines.
+type countDispatcher struct{
+	count int64
+}
+
+func (d *countDispatcher) Dispatch(a Action, c *Context){
+	atomic.AddInt64(&d.count, 1)
+}
+
+// timers fire while other goroutines send events, run with -race
+func TestTimersConcurrently(t *testing.T) {
+	d := &countDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetTimeoutEvent(timeoutEvent).
+	  AddTimeoutDuration("s1", time.Millisecond).
+	  AddTimeoutDuration("s2", time.Millisecond).
+	  AddStateTimer("s1", StateTimer{"tick", time.Millisecond, e3, true}).
+	  AddStateTimer("s2", StateTimer{"tick", time.Millisecond, e3, true}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "timeoutEvt"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s1", EventName: "timeoutEvt"}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s2", TargetID: "s1", EventName: "e1"}).
+	  AddTransition(Transition{SourceID: "s1", EventName: "e3"}, Action{"tick", nil}).
+	  AddTransition(Transition{SourceID: "s2", EventName: "e3"}, Action{"tick", nil})
+	sm.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				sm.SendEvent(e1)
+				sm.SendEventAfter(e1, time.Millisecond)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+	sm.Stop()
+
+	// no timer fires after stopping
+	count := atomic.LoadInt64(&d.count)
+	time.Sleep(20 * time.Millisecond)
+	verify(t, "TestTimersConcurrently", atomic.LoadInt64(&d.count), count)
+}
@@ -0,0 +1,102 @@
+package test
+
+import (
+    "testing"
+    "time"
+    . ".."
+)
+
+var remind, expire Event = &myEvent{"remind"}, &myEvent{"expire"}
+
+func TestStateTimer(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	d := &nameDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.AddStates(states).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  AddStateTimer("s1", StateTimer{"reminder", time.Hour, remind, true}).
+	  AddStateTimer("s1", StateTimer{"expire", 3 * time.Hour + time.Minute, expire, false}).
+	  AddTransition(Transition{SourceID: "s1", EventName: "remind"}, Action{"remind", nil}).
+	  AddTransition(Transition{SourceID: "s1", TargetID: "s2", EventName: "expire"})
+	verify(t, "TestStateTimer 1", len(sm.GetStateTimers(s1)), 2)
+	sm.Start()
+	
+	clock.Advance(30 * time.Minute)
+	verify(t, "TestStateTimer 2", d.result, "")
+	clock.Advance(30 * time.Minute)
+	verify(t, "TestStateTimer 3", d.result, "remind|")
+	clock.Advance(2 * time.Hour)
+	verify(t, "TestStateTimer 4", d.result, "remind|remind|remind|")
+	verify(t, "TestStateTimer 5", sm.GetCurrentState().ID(), "s1")
+	
+	// all timers are cancelled after exiting s1
+	clock.Advance(time.Minute)
+	verify(t, "TestStateTimer 6", sm.GetCurrentState().ID(), "s2")
+	verify(t, "TestStateTimer 7", clock.PendingTimers(), 0)
+	clock.Advance(time.Hour)
+	verify(t, "TestStateTimer 8", d.result, "remind|remind|remind|")
+}
+
+// timers of states are cancelled when stopping
+func TestStateTimerStop(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	sm := NewStateMachine(nil, nil)
+	sm.AddStates([]State{s1, s2}).
+	  AddSubStates("s1", []State{s3}).
+	  SetInitialStateID("s1").
+	  SetClock(clock).
+	  AddStateTimer("s1", StateTimer{"t1", time.Second, e1, true}).
+	  AddStateTimer("s3", StateTimer{"t3", time.Second, e3, false})
+	sm.Start()
+	verify(t, "TestStateTimerStop 1", clock.PendingTimers(), 2)
+	sm.Stop()
+	verify(t, "TestStateTimerStop 2", clock.PendingTimers(), 0)
+}
+
+func verifyTimerConfig(t *testing.T, name string, cfg Configurer) {
+	clock := NewManualClock(time.Now())
+	d := &nameDispatcher{}
+	sm := NewStateMachine(nil, d)
+	sm.SetClock(clock)
+	sm.LoadConfig(cfg)
+	timers := sm.GetStateTimers(&myState{"waiting"})
+	verify(t, name + " 1", len(timers), 2)
+	verify(t, name + " 2", timers[0].Name, "reminder")
+	verify(t, name + " 3", timers[0].Repeat, true)
+	verify(t, name + " 4", timers[1].Delay, 24 * time.Hour)
+	verify(t, name + " 5", timers[1].Event.Name(), "expire")
+	
+	sm.Start()
+	clock.Advance(24 * time.Hour)
+	verify(t, name + " 6", sm.GetCurrentState().ID(), "expired")
+	verify(t, name + " 7", len(d.result), len("a.remind|") * 23)
+}
+
+func TestConfigFileTimerXML(t *testing.T) {
+	verifyTimerConfig(t, "TestConfigFileTimerXML", NewConfigurerXML(dir + "stateMachine_timer.xml"))
+}
+
+func TestConfigFileTimerJSON(t *testing.T) {
+	verifyTimerConfig(t, "TestConfigFileTimerJSON", NewConfigurerJSON(dir + "stateMachine_timer.json"))
+}
+
+func TestStateTimerError(t *testing.T) {
+	sm := NewStateMachine(nil, nil).AddStates(states).AddStateTimer("s1", StateTimer{"t1", time.Second, e1, false})
+	err := sm.Configure(func(sm *StateMachine){
+		sm.AddStateTimer("s1", StateTimer{"t1", time.Second, e1, false})
+	})
+	verify(t, "TestStateTimerError 1", err.Error(), "Duplicate timer [t1] of state [s1].")
+	err = sm.Configure(func(sm *StateMachine){
+		sm.AddStateTimer("s1", StateTimer{"t2", 0, e1, false})
+	})
+	verify(t, "TestStateTimerError 2", err.Error(), "Delay of timer [t2] should be greater than zero.")
+	err = sm.Configure(func(sm *StateMachine){
+		sm.AddStateTimer("s1", StateTimer{"t2", time.Second, nil, false})
+	})
+	verify(t, "TestStateTimerError 3", err.Error(), "Timer [t2] has no event.")
+	err = sm.Configure(func(sm *StateMachine){
+		sm.AddStateTimer("s7", StateTimer{"t2", time.Second, e1, false})
+	})
+	verify(t, "TestStateTimerError 4", err.Error(), "Has no state [s7].")
+}
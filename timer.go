@@ -0,0 +1,145 @@
+package hackberry
+
+import (
+    "time"
+)
+
+// StateTimer defines a named timer of a state. The timer starts when entering
+// the state, and sends its event to state machine after the delay. If it
+// repeats, it sends the event every delay while the state is active. All
+// timers of a state are cancelled when exiting the state.
+type StateTimer struct{
+    // Name is the name of timer, it should be unique in the state.
+    Name string
+
+    // Delay is the duration from entering the state or last firing to firing.
+    Delay time.Duration
+
+    // Event is the event sent when the timer fires.
+    Event Event
+
+    // Repeat defines if the timer fires repeatedly.
+    Repeat bool
+}
+
+// runningTimer is a timer of an active state.
+type runningTimer struct{
+    stateID string
+    timer StateTimer
+
+    // the generation of the state when starting the timer
+    generation uint64
+
+    // the timer created by clock, for the next firing
+    handle Timer
+
+    // the time of the next firing
+    due time.Time
+}
+
+// timerEvent is sent to state machine when a running timer fires, then the
+// event of timer is processed if the timer is not stale.
+type timerEvent struct{
+    running *runningTimer
+}
+
+func (e *timerEvent) Name() string{
+    return e.running.timer.Event.Name()
+}
+
+// AddStateTimer adds a named timer to a state. It does not need the timeout
+// event of state machine, each timer has its own event.
+func (sm *StateMachine) AddStateTimer(stateID string, timer StateTimer) *StateMachine{
+    sm.checkMutable()
+    if sm.states[stateID] == nil {
+        panic(&ConfigError{Message: "Has no state [" + stateID + "]."})
+    }
+    if timer.Name == "" {
+        panic(&ConfigError{Message: "Timer of state [" + stateID + "] has no name."})
+    }
+    if timer.Delay <= 0 {
+        panic(&ConfigError{Message: "Delay of timer [" + timer.Name + "] should be greater than zero."})
+    }
+    if timer.Event == nil {
+        panic(&ConfigError{Message: "Timer [" + timer.Name + "] has no event."})
+    }
+    for _, t := range sm.stateTimers[stateID] {
+        if t.Name == timer.Name {
+            panic(&ConfigError{Message: "Duplicate timer [" + timer.Name + "] of state [" + stateID + "]."})
+        }
+    }
+
+    sm.stateTimers[stateID] = append(sm.stateTimers[stateID], timer)
+    return sm
+}
+
+// GetStateTimers returns the named timers of a state.
+func (sm *StateMachine) GetStateTimers(state State) []StateTimer{
+    return sm.stateTimers[state.ID()]
+}
+
+// startTimers starts the timeout and the named timers of a state when entering
+// it. Each entering has a new generation, the timers of last entering are
+// stale. Should lock before call this method.
+func (sm *StateMachine) startTimers(stateID string){
+    sm.generations[stateID]++
+
+    timers := sm.stateTimers[stateID]
+    if d := sm.timeouts[stateID]; d > 0 {
+        timers = append([]StateTimer{{Delay: d, Event: sm.timeoutEvent}}, timers...)
+    }
+    for _, t := range timers {
+        r := &runningTimer{stateID: stateID, timer: t, generation: sm.generations[stateID]}
+        sm.startTimer(r, t.Delay)
+        sm.runningTimers[stateID] = append(sm.runningTimers[stateID], r)
+    }
+}
+
+// startTimer creates the clock timer for the next firing after the delay. The
+// clock only posts the timer event, which never blocks and never panics, the
+// timer is checked when processing the timer event. Should lock before call
+// this method.
+func (sm *StateMachine) startTimer(r *runningTimer, delay time.Duration){
+    r.due = sm.clock.Now().Add(delay)
+    r.handle = sm.clock.AfterFunc(delay, func(){
+        sm.post(&timerEvent{r})
+    })
+}
+
+// cancelTimers stops the timers of a state when exiting it. Stopping a clock
+// timer never blocks, if it has fired already, its event is discarded because
+// the generation is changed. Should lock before call this method.
+func (sm *StateMachine) cancelTimers(stateID string){
+    sm.generations[stateID]++
+
+    for _, r := range sm.runningTimers[stateID] {
+        r.handle.Stop()
+    }
+    delete(sm.runningTimers, stateID)
+}
+
+// timerFired returns the event of a fired timer, or nil if the timer is stale.
+// A repeating timer is started again. Should lock before call this method.
+func (sm *StateMachine) timerFired(e *timerEvent) Event{
+    r := e.running
+    if !sm.active[r.stateID] || sm.generations[r.stateID] != r.generation {
+        return nil
+    }
+
+    if r.timer.Repeat {
+        sm.startTimer(r, r.timer.Delay)
+    }else{
+        l := sm.runningTimers[r.stateID]
+        for i, o := range l {
+            if o == r {
+                sm.runningTimers[r.stateID] = append(l[:i:i], l[i+1:]...)
+                break
+            }
+        }
+    }
+
+    sm.notify(func(l Listener){
+        l.OnTimeout(&sm.context, sm.states[r.stateID], r.timer.Event)
+    })
+    return r.timer.Event
+}